@@ -0,0 +1,181 @@
+package autoscaler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/controller"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+)
+
+// runAPI serves the admin API on ADMIN_API_ADDRESS.
+func (a *KVMAutoScaler) runAPI() {
+	r := chi.NewRouter()
+
+	r.Get("/groups/{group}/instances", a.GetInstancesHandler)
+	r.Put("/groups/{group}/instances/{instance}/protection", a.SetScaleInProtectionHandler)
+	r.Put("/groups/{group}/instances/{instance}/tags", a.SetInstanceTagHandler)
+	r.Get("/groups/{group}/lifecycle", a.GetLifecycleActionsHandler)
+	r.Get("/groups/{group}/quota", a.GetGroupQuotaHandler)
+	r.Get("/tenants/{tenant}/quota", a.GetTenantQuotaHandler)
+	r.Post("/groups/{group}/lifecycle/complete", a.CompleteLifecycleActionHandler)
+
+	address := helper.GetEnv("ADMIN_API_ADDRESS", ":8070")
+	log.Printf("[KVMAutoScaler] Admin API running on %s\n", address)
+	log.Println(http.ListenAndServe(address, r))
+}
+
+func (a *KVMAutoScaler) getGroupFromRequest(w http.ResponseWriter, r *http.Request) (*instanceGroup, bool) {
+	group, ok := a.groups[chi.URLParam(r, "group")]
+	if !ok {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return nil, false
+	}
+	return group, true
+}
+
+type InstanceResponse struct {
+	ID              string            `json:"id"`
+	Host            string            `json:"host"`
+	Status          int               `json:"status"`
+	BackendURL      string            `json:"backendUrl"`
+	TemplateVersion string            `json:"templateVersion"`
+	InstanceType    string            `json:"instanceType"`
+	Weight          int               `json:"weight"`
+	BootTime        string            `json:"bootTime"`
+	Protected       bool              `json:"protected"`
+	Tags            map[string]string `json:"tags"`
+}
+
+func (a *KVMAutoScaler) GetInstancesHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := a.getGroupFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	result := []InstanceResponse{}
+	for _, inst := range group.vmController.GetInstances() {
+		result = append(result, InstanceResponse{
+			ID:              inst.GetID(),
+			Host:            inst.GetHost(),
+			Status:          int(inst.GetStatus()),
+			BackendURL:      inst.GetBackendURL(),
+			TemplateVersion: inst.GetTemplateVersion(),
+			InstanceType:    inst.GetInstanceType(),
+			Weight:          inst.GetWeight(),
+			BootTime:        inst.GetBootTime().Format(time.RFC3339),
+			Protected:       inst.IsScaleInProtected(),
+			Tags:            inst.GetTags(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+type ScaleInProtectionRequest struct {
+	Protected bool `json:"protected"`
+}
+
+func (a *KVMAutoScaler) SetScaleInProtectionHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := a.getGroupFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var protectionRequest ScaleInProtectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&protectionRequest); err != nil {
+		http.Error(w, "invalid body request", http.StatusBadRequest)
+		return
+	}
+
+	if err := group.vmController.SetScaleInProtection(chi.URLParam(r, "instance"), protectionRequest.Protected); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// InstanceTagRequest sets a tag of an instance, an empty value removes it.
+type InstanceTagRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (a *KVMAutoScaler) SetInstanceTagHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := a.getGroupFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var tagRequest InstanceTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&tagRequest); err != nil || tagRequest.Key == "" {
+		http.Error(w, "invalid body request", http.StatusBadRequest)
+		return
+	}
+
+	if err := group.vmController.SetInstanceTag(chi.URLParam(r, "instance"), tagRequest.Key, tagRequest.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetGroupQuotaHandler returns the usage and remaining quota of the group
+// and of its tenant.
+func (a *KVMAutoScaler) GetGroupQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := a.getGroupFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group.vmController.GetQuotaStatus())
+}
+
+func (a *KVMAutoScaler) GetTenantQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := a.tenants[chi.URLParam(r, "tenant")]
+	if !ok {
+		http.Error(w, "tenant not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenant.Status())
+}
+
+func (a *KVMAutoScaler) GetLifecycleActionsHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := a.getGroupFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group.vmController.GetPendingLifecycleActions())
+}
+
+func (a *KVMAutoScaler) CompleteLifecycleActionHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := a.getGroupFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var completion controller.LifecycleCompletion
+	if err := json.NewDecoder(r.Body).Decode(&completion); err != nil {
+		http.Error(w, "invalid body request", http.StatusBadRequest)
+		return
+	}
+
+	if err := group.vmController.CompleteLifecycleAction(completion.Token, completion.Result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,15 @@
+package autoscaler
+
+import (
+	"github.com/linlynnn/kvm-autoscaler/pkgs/controller"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/lb"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/policy"
+)
+
+// instanceGroup is everything the autoscaler runs for one group.
+type instanceGroup struct {
+	config          controller.GroupConfig
+	vmController    controller.VmController
+	loadBalancer    *lb.LoadBalancer
+	scalingPolicies []policy.ScalingPolicy
+}
@@ -1,76 +1,282 @@
 package autoscaler
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 
 	"github.com/linlynnn/kvm-autoscaler/pkgs/controller"
 	"github.com/linlynnn/kvm-autoscaler/pkgs/discovery"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
 	"github.com/linlynnn/kvm-autoscaler/pkgs/lb"
 	"github.com/linlynnn/kvm-autoscaler/pkgs/policy"
-	"libvirt.org/go/libvirt"
 )
 
 type KVMAutoScaler struct {
-	scalingPolicies []policy.ScalingPolicy
-	vmController    controller.VmController
-	loadBalancer    *lb.LoadBalancer
+	scheduler *host.Scheduler
+	// launchQueue bounds the creations of all groups, they share the hosts
+	launchQueue *controller.LaunchQueue
+	groups      map[string]*instanceGroup
+	groupNames  []string
+	// tenants are the quotas shared between groups
+	tenants map[string]*controller.TenantQuota
 }
 
 func New(loadBalancer *lb.LoadBalancer) *KVMAutoScaler {
+	// the host list is needed before Run, so the .env file is loaded here
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("[KVMAutoScaler] Error loading .env file")
+	}
+
+	hosts := []*host.Host{}
+	for _, hostURI := range strings.Split(helper.GetEnv("LIBVIRT_HOST_URIS", "qemu:///system"), ",") {
+		hostURI = strings.TrimSpace(hostURI)
+		if hostURI == "" {
+			continue
+		}
+
+		// an unreachable hypervisor is retried in the background, scaling
+		// on it pauses until it is back
+		h, err := host.Connect(hostURI)
+		if err != nil {
+			log.Printf("[KVMAutoScaler] Hypervisor %s is unreachable, keep retrying: %v\n", hostURI, err)
+		}
+		hosts = append(hosts, h)
+	}
+
+	scheduler := host.NewScheduler(
+		hosts,
+		host.PlacementStrategy(helper.GetEnv("PLACEMENT_STRATEGY", string(host.PLACEMENT_STRATEGY_SPREAD))),
+		host.AdmissionPolicyFromEnv(),
+	)
+
+	a := &KVMAutoScaler{
+		scheduler:   scheduler,
+		launchQueue: controller.LaunchQueueFromEnv(),
+		groups:      make(map[string]*instanceGroup),
+		tenants:     make(map[string]*controller.TenantQuota),
+	}
+
+	if tenantsFile := os.Getenv("TENANT_QUOTAS_FILE"); tenantsFile != "" {
+		tenants, err := controller.LoadTenantQuotas(tenantsFile)
+		if err != nil {
+			log.Fatalf("[KVMAutoScaler] Failed to load %s: %v", tenantsFile, err)
+		}
+		for _, tenant := range tenants {
+			a.tenants[tenant.Name] = tenant
+		}
+	}
+
+	groupsFile := os.Getenv("INSTANCE_GROUPS_FILE")
+	if groupsFile == "" {
+		if err := a.AddGroup(controller.DefaultGroupConfigFromEnv(), loadBalancer); err != nil {
+			log.Fatalf("[KVMAutoScaler] Invalid default group: %v", err)
+		}
+		return a
+	}
 
-	conn, err := libvirt.NewConnect("qemu:///system")
+	groupConfigs, err := controller.LoadGroupConfigs(groupsFile)
 	if err != nil {
-		log.Fatalf("[KVMAutoScaler] Failed to connect to hypervisor: %v", err)
+		log.Fatalf("[KVMAutoScaler] Failed to load %s: %v", groupsFile, err)
+	}
+
+	// the load balancer given to New serves the default group, or the first
+	// group when the file has none
+	servedGroup := groupConfigs[0].Name
+	for _, groupConfig := range groupConfigs {
+		if groupConfig.Name == "default" {
+			servedGroup = groupConfig.Name
+		}
+	}
+
+	for _, groupConfig := range groupConfigs {
+		groupLoadBalancer := loadBalancer
+		if groupConfig.Name != servedGroup {
+			groupLoadBalancer = nil
+		}
+
+		if err := a.AddGroup(groupConfig, groupLoadBalancer); err != nil {
+			log.Fatalf("[KVMAutoScaler] Invalid group %s: %v", groupConfig.Name, err)
+		}
+	}
+
+	return a
+
+}
+
+// AddGroup starts managing a new instance group. When loadBalancer is nil
+// and the group has a LoadBalancerAddress, an in-process load balancer is
+// created for it.
+func (a *KVMAutoScaler) AddGroup(groupConfig controller.GroupConfig, loadBalancer *lb.LoadBalancer) error {
+	if err := groupConfig.Validate(); err != nil {
+		return err
+	}
+
+	if _, ok := a.groups[groupConfig.Name]; ok {
+		return fmt.Errorf("group %s already exists", groupConfig.Name)
+	}
+
+	if loadBalancer == nil && groupConfig.LoadBalancerAddress != "" {
+		loadBalancer = lb.NewLoadBalancer(groupConfig.LoadBalancerAddress)
 	}
 
 	virtController := controller.NewVirtController(
-		conn,
+		a.scheduler,
+		a.launchQueue,
+		groupConfig,
 		30*time.Second,
 		30*time.Second,
-		loadBalancer,
 	)
 
-	return &KVMAutoScaler{
-		scalingPolicies: []policy.ScalingPolicy{},
+	// a tenant without a quota is unlimited, its usage is still reported
+	if groupConfig.Tenant != "" {
+		tenant, ok := a.tenants[groupConfig.Tenant]
+		if !ok {
+			tenant = controller.NewTenantQuota(groupConfig.Tenant, controller.Quota{})
+			a.tenants[groupConfig.Tenant] = tenant
+		}
+		tenant.Join(virtController)
+	}
+
+	a.groups[groupConfig.Name] = &instanceGroup{
+		config:          groupConfig,
 		vmController:    virtController,
 		loadBalancer:    loadBalancer,
+		scalingPolicies: []policy.ScalingPolicy{},
 	}
+	a.groupNames = append(a.groupNames, groupConfig.Name)
 
+	log.Printf("[KVMAutoScaler] Added group %s\n", groupConfig.Name)
+	return nil
 }
 
+// AttachPolicy attaches policies to the first group, which is the default
+// group unless groups are loaded from INSTANCE_GROUPS_FILE.
 func (a *KVMAutoScaler) AttachPolicy(policies []policy.ScalingPolicy) {
+	if len(a.groupNames) == 0 {
+		log.Println("[KVMAutoScaler] No group to attach policies to")
+		return
+	}
+
+	a.AttachGroupPolicy(a.groupNames[0], policies)
+}
+
+func (a *KVMAutoScaler) AttachGroupPolicy(groupName string, policies []policy.ScalingPolicy) error {
+	group, ok := a.groups[groupName]
+	if !ok {
+		return fmt.Errorf("group %s does not exist", groupName)
+	}
+
 	for _, policy := range policies {
-		policy.AttachVmController(a.vmController)
+		policy.AttachVmController(group.vmController)
 	}
-	a.scalingPolicies = policies
+	group.scalingPolicies = policies
+	return nil
 }
 
-func (a *KVMAutoScaler) Run() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("[KVMAutoScaler] Error loading .env file")
+// UpdateGroup changes the template of a group and starts an instance refresh
+// that rolls the running instances over to it.
+func (a *KVMAutoScaler) UpdateGroup(groupConfig controller.GroupConfig, refreshConfig controller.RefreshConfig) error {
+	group, ok := a.groups[groupConfig.Name]
+	if !ok {
+		return fmt.Errorf("group %s does not exist", groupConfig.Name)
 	}
 
-	var wg sync.WaitGroup
+	if err := group.vmController.UpdateGroup(groupConfig); err != nil {
+		return err
+	}
+	group.config = groupConfig
 
-	for _, policy := range a.scalingPolicies {
-		wg.Add(1)
-		go policy.Apply()
+	return group.vmController.StartInstanceRefresh(refreshConfig)
+}
 
+// ReloadGroups re-reads the .env file and INSTANCE_GROUPS_FILE, groups whose
+// template changed are refreshed. Groups are not added or removed.
+func (a *KVMAutoScaler) ReloadGroups() {
+	if err := godotenv.Overload(); err != nil {
+		log.Printf("[KVMAutoScaler] Failed to reload .env file: %v\n", err)
+		return
 	}
 
-	if a.loadBalancer != nil {
-		go a.loadBalancer.Run()
+	groupConfigs := []controller.GroupConfig{controller.DefaultGroupConfigFromEnv()}
+	if groupsFile := os.Getenv("INSTANCE_GROUPS_FILE"); groupsFile != "" {
+		loaded, err := controller.LoadGroupConfigs(groupsFile)
+		if err != nil {
+			log.Printf("[KVMAutoScaler] Failed to reload %s: %v\n", groupsFile, err)
+			return
+		}
+		groupConfigs = loaded
+	}
+
+	for _, groupConfig := range groupConfigs {
+		group, ok := a.groups[groupConfig.Name]
+		if !ok {
+			log.Printf("[KVMAutoScaler] Skip unknown group %s on reload\n", groupConfig.Name)
+			continue
+		}
+
+		if err := groupConfig.Validate(); err != nil {
+			log.Printf("[KVMAutoScaler] Skip invalid group %s on reload: %v\n", groupConfig.Name, err)
+			continue
+		}
+
+		if group.config.TemplateVersion() == groupConfig.TemplateVersion() {
+			continue
+		}
+
+		if err := a.UpdateGroup(groupConfig, controller.RefreshConfigFromEnv()); err != nil {
+			log.Printf("[KVMAutoScaler] Failed to refresh group %s: %v\n", groupConfig.Name, err)
+			continue
+		}
+		log.Printf("[KVMAutoScaler] Started instance refresh of group %s\n", groupConfig.Name)
+	}
+}
+
+func (a *KVMAutoScaler) Run() {
+	var wg sync.WaitGroup
+
+	for _, groupName := range a.groupNames {
+		group := a.groups[groupName]
+		group.vmController.Run()
+
+		for _, policy := range group.scalingPolicies {
+			wg.Add(1)
+			go policy.Apply()
+
+		}
+
+		if group.loadBalancer != nil {
+			go group.loadBalancer.Run()
+		}
 	}
 
 	sDiscovery := discovery.NewPromServiceDiscovery()
 	go sDiscovery.Run()
 
+	go a.runAPI()
+
+	// SIGHUP reloads the group templates and refreshes changed groups
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			a.ReloadGroups()
+		}
+	}()
+
 	wg.Wait()
-	a.vmController.Close()
+	for _, groupName := range a.groupNames {
+		a.groups[groupName].vmController.Close()
+	}
+	a.scheduler.Close()
 
 }
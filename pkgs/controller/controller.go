@@ -5,6 +5,22 @@ import "github.com/linlynnn/kvm-autoscaler/pkgs/instance"
 type VmController interface {
 	ScaleUp(numToAdd int)
 	ScaleDown(instancesToRemove []instance.InstanceManager)
+	ScaleVertical(steps int) int
+	VerticalHeadroom() (int, int)
 	GetRunningInstance() (int, []instance.InstanceManager, error)
+	GetRunningCapacity() int
+	SelectScaleInCandidates(numToRemove int) []instance.InstanceManager
+	GetPendingLaunches() []PendingLaunch
+	GetQuotaStatus() []QuotaStatus
+	GetInstances() []instance.InstanceManager
+	SetScaleInProtection(instanceID string, protected bool) error
+	SetInstanceTag(instanceID string, key string, value string) error
+	SelectInstancesByTag(key string, value string) []instance.InstanceManager
+	UpdateGroup(group GroupConfig) error
+	StartInstanceRefresh(config RefreshConfig) error
+	GetInstanceRefreshStatus() RefreshStatus
+	CompleteLifecycleAction(token string, result LifecycleResult) error
+	GetPendingLifecycleActions() []LifecycleAction
+	Run()
 	Close()
 }
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/lb"
+)
+
+// waitForDrain blocks until the load balancer reports no in-flight requests
+// for the instance or DRAINING_TIME_SEC passes.
+func (m *VirtController) waitForDrain(inst instance.InstanceManager) {
+	drainingTime := time.Duration(helper.GetEnvInt("DRAINING_TIME_SEC", 30)) * time.Second
+	deadline := time.Now().Add(drainingTime)
+
+	log.Printf("[VirtController] Draining connection %s, deadline %v\n", inst.GetID(), drainingTime)
+	for {
+		activeConnections, err := m.getActiveConnections(inst.GetBackendURL())
+		if err != nil {
+			log.Printf("[VirtController] Failed to get connections of %s: %v\n", inst.GetID(), err)
+		} else if activeConnections == 0 {
+			log.Printf("[VirtController] Drained %s\n", inst.GetID())
+			return
+		}
+
+		if time.Now().After(deadline) {
+			log.Printf("[VirtController] Drain deadline passed for %s with %d active connections\n", inst.GetID(), activeConnections)
+			return
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func (m *VirtController) getActiveConnections(backendURL string) (int64, error) {
+	resp, err := http.Get(m.getGroup().LoadBalancerURL + "/backend/connections?url=" + url.QueryEscape(backendURL))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// the load balancer already removed the backend
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+
+	var connections lb.BackendConnectionsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&connections); err != nil {
+		return 0, err
+	}
+
+	return connections.ActiveConnections, nil
+}
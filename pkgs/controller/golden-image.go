@@ -0,0 +1,467 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	genconfig "github.com/linlynnn/kvm-autoscaler/pkgs/gen-config"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+	"libvirt.org/go/libvirt"
+)
+
+type FastBootMode string
+
+const (
+	FAST_BOOT_MODE_COLD     FastBootMode = "cold"
+	FAST_BOOT_MODE_SNAPSHOT FastBootMode = "snapshot"
+)
+
+// IMAGE_DIR holds the golden memory state and the clones restored from it.
+const IMAGE_DIR = "/var/lib/libvirt/images"
+
+var (
+	domainUUIDPattern = regexp.MustCompile(`<uuid>([0-9a-f-]{36})</uuid>`)
+	macAddressPattern = regexp.MustCompile(`<mac address='([0-9a-f:]{17})'/>`)
+)
+
+// GoldenImage is a fully provisioned instance whose memory state was saved
+// once, new instances are restored from a copy of it instead of booting cold.
+type GoldenImage struct {
+	sync.RWMutex
+	// templateVersion of the group when the golden instance was booted
+	templateVersion string
+	host            *host.Host
+	id              string
+	statePath       string
+	domainUUID      string
+	macAddress      string
+	// pool holds the overlay of the golden instance
+	pool  string
+	ready bool
+	// restoring counts the restores in flight by golden instance id
+	restoring map[string]int
+	// retired are golden images of older templates that may still back
+	// restored instances
+	retired []retiredGoldenImage
+}
+
+// retiredGoldenImage is deleted once no domain on its host is restored from
+// it.
+type retiredGoldenImage struct {
+	host      *host.Host
+	pool      string
+	id        string
+	statePath string
+}
+
+// isReadyOn reports whether instances of templateVersion placed on h can be
+// restored, the state file only exists on the host the golden instance ran
+// on.
+func (g *GoldenImage) isReadyOn(h *host.Host, templateVersion string) bool {
+	g.RLock()
+	defer g.RUnlock()
+	return g.ready && g.host == h && g.templateVersion == templateVersion
+}
+
+// reset drops the golden state after the group template changed.
+func (g *GoldenImage) reset() {
+	g.Lock()
+	defer g.Unlock()
+	g.retire()
+}
+
+// retire must be called with g locked.
+func (g *GoldenImage) retire() {
+	if g.id != "" {
+		g.retired = append(g.retired, retiredGoldenImage{
+			host:      g.host,
+			pool:      g.pool,
+			id:        g.id,
+			statePath: g.statePath,
+		})
+	}
+	g.id = ""
+	g.ready = false
+}
+
+// beginRestore returns a copy of the golden image when it is ready, it
+// stays in use until endRestore even if it is retired meanwhile.
+func (g *GoldenImage) beginRestore() (GoldenImage, bool) {
+	g.Lock()
+	defer g.Unlock()
+
+	if !g.ready {
+		return GoldenImage{}, false
+	}
+
+	if g.restoring == nil {
+		g.restoring = make(map[string]int)
+	}
+	g.restoring[g.id]++
+
+	return GoldenImage{
+		templateVersion: g.templateVersion,
+		id:              g.id,
+		statePath:       g.statePath,
+		domainUUID:      g.domainUUID,
+		macAddress:      g.macAddress,
+	}, true
+}
+
+func (g *GoldenImage) endRestore(id string) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.restoring[id]--
+	if g.restoring[id] <= 0 {
+		delete(g.restoring, id)
+	}
+}
+
+func (m *VirtController) prepareGoldenImage() error {
+
+	log.Println("[GoldenImage] Preparing golden instance")
+	group := m.getGroup()
+	primary := group.primaryType()
+	req := group.request(primary)
+
+	// the state file is cloned through the local filesystem, so the golden
+	// instance must run on a local hypervisor
+	var h *host.Host
+	for _, candidate := range m.scheduler.Hosts() {
+		if candidate.IsLocal() {
+			h = candidate
+			break
+		}
+	}
+	if h == nil {
+		err := fmt.Errorf("snapshot mode needs a local hypervisor")
+		log.Println(err)
+		return err
+	}
+
+	if err := m.scheduler.Reserve(h, req); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	instanceMng, err := m.bootVM(h, group, primary)
+	m.scheduler.Done(h, req)
+	if err != nil {
+		return err
+	}
+
+	// the saved memory must hold a fully provisioned guest
+	if err := instanceMng.WaitUntilReady(context.Background()); err != nil {
+		instanceMng.Shutdown()
+		return err
+	}
+
+	id := strings.TrimPrefix(instanceMng.GetID(), "instance-")
+	statePath := filepath.Join(IMAGE_DIR, "golden-"+id+".save")
+	if err := instanceMng.SaveState(statePath); err != nil {
+		instanceMng.Shutdown()
+		return err
+	}
+
+	// a golden state that cannot be used is dropped along with its instance
+	discard := func(err error) error {
+		log.Println(err)
+		instanceMng.Shutdown()
+		removeStateFile(statePath)
+		return err
+	}
+
+	// the state file is created by libvirtd, make it readable for cloning
+	cmd := exec.Command("sudo", "chmod", "0644", statePath)
+	if err := cmd.Run(); err != nil {
+		return discard(err)
+	}
+
+	conn := h.Conn()
+	if conn == nil {
+		return discard(fmt.Errorf("hypervisor %s is unreachable", h.URI))
+	}
+
+	domainXML, err := conn.DomainSaveImageGetXMLDesc(statePath, 0)
+	if err != nil {
+		return discard(err)
+	}
+
+	domainUUID := domainUUIDPattern.FindStringSubmatch(domainXML)
+	macAddress := macAddressPattern.FindStringSubmatch(domainXML)
+	if domainUUID == nil || macAddress == nil {
+		return discard(fmt.Errorf("golden state %s has no uuid or mac address", statePath))
+	}
+
+	// the overlay of the golden instance becomes the read-only backing image
+	// of every restored instance, so the domain must never run again and
+	// its volume must outlive it
+	instanceMng.KeepVolumes()
+	if err := instanceMng.Shutdown(); err != nil {
+		return err
+	}
+	// only the overlay is needed, the seed was read at first boot
+	m.deleteVolumes(h, []genconfig.OverlayVolume{{Pool: group.StoragePool, Name: genconfig.SeedVolumeName(id)}})
+
+	m.goldenImage.Lock()
+	m.goldenImage.retire()
+	m.goldenImage.templateVersion = instanceMng.GetTemplateVersion()
+	m.goldenImage.host = h
+	m.goldenImage.id = id
+	m.goldenImage.statePath = statePath
+	m.goldenImage.domainUUID = domainUUID[1]
+	m.goldenImage.macAddress = macAddress[1]
+	m.goldenImage.pool = group.StoragePool
+	m.goldenImage.ready = true
+	m.goldenImage.Unlock()
+
+	log.Printf("[GoldenImage] Golden state ready %s\n", statePath)
+	return nil
+
+}
+
+// restoreVM creates an instance from a copy of the golden memory state and
+// applies the identity fixups through the guest agent.
+func (m *VirtController) restoreVM(h *host.Host, group GroupConfig, fleetType FleetInstanceType) (*instance.VirtInstanceManager, error) {
+
+	// the golden image may be reset since launchVM checked it
+	golden, ok := m.goldenImage.beginRestore()
+	if !ok {
+		return nil, fmt.Errorf("golden image was reset")
+	}
+	defer m.goldenImage.endRestore(golden.id)
+
+	id := uuid.New().String()
+	instanceId := "instance-" + id
+	log.Printf("[VirtController] Restoring VM %s\n", instanceId)
+
+	// the domain XML in the state refers to the overlay by name, which the
+	// clone renames along with the instance id
+	conn := h.Conn()
+	if conn == nil {
+		err := fmt.Errorf("hypervisor %s is unreachable", h.URI)
+		log.Println(err)
+		return nil, err
+	}
+
+	overlay, err := genconfig.GenOverlayVolume(conn, group.StoragePool, id, genconfig.OverlayVolumeName(golden.id), group.DiskMiB)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	// the domain XML in the state refers to the seed volume by name too
+	volumes := []genconfig.OverlayVolume{overlay}
+	defined := false
+	defer func() {
+		if !defined {
+			m.deleteVolumes(h, volumes)
+		}
+	}()
+
+	seed, err := m.genCloudInitConfig(conn, id, group)
+	if err != nil {
+		return nil, err
+	}
+	volumes = append(volumes, seed)
+
+	macAddress, err := randomMACAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	statePath := filepath.Join(IMAGE_DIR, "restore-"+id+".save")
+	err = genconfig.CloneSaveImage(golden.statePath, statePath, map[string]string{
+		golden.id:         id,
+		golden.domainUUID: uuid.New().String(),
+		golden.macAddress: macAddress,
+	})
+	defer os.Remove(statePath)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	if err := conn.DomainRestoreFlags(statePath, "", libvirt.DOMAIN_SAVE_RUNNING); err != nil {
+		log.Printf("[VirtController] Failed to restore domain: %v\n", err)
+		return nil, err
+	}
+
+	// restored domains are transient until defined, one that fails to be
+	// defined is destroyed before its overlay is deleted
+	defer func() {
+		if !defined {
+			destroyTransientDomain(conn, instanceId)
+		}
+	}()
+
+	domain, err := conn.LookupDomainByName(instanceId)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	domainXML, err := domain.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	domain, err = conn.DomainDefineXML(domainXML)
+	if err != nil {
+		log.Printf("[VirtController] Failed to define domain: %v\n", err)
+		return nil, err
+	}
+	// the defined domain holds the overlay from here on
+	defined = true
+
+	instanceMng := instance.NewVirtInstanceManager(domain, instanceId, h.URI, group.TargetPort, golden.templateVersion, fleetType.Type, fleetType.Weight)
+	instanceMng.WatchState(h)
+	if err := instanceMng.ApplyIdentity(instanceId, macAddress); err != nil {
+		instanceMng.Shutdown()
+		return nil, err
+	}
+
+	// the metadata was copied from the golden instance, it must name the
+	// golden image so that its overlay is kept while the instance exists
+	md := instanceMetadata(group, fleetType)
+	md.TemplateVersion = golden.templateVersion
+	md.GoldenImage = golden.id
+	if err := instanceMng.SetMetadata(md); err != nil {
+		log.Printf("[VirtController] Failed to write metadata of %s: %v\n", instanceId, err)
+		instanceMng.Shutdown()
+		return nil, err
+	}
+
+	log.Printf("[VirtController] Restored VM %s\n", instanceId)
+	return instanceMng, nil
+
+}
+
+func randomMACAddress() (string, error) {
+	buf := make([]byte, 3)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", buf[0], buf[1], buf[2]), nil
+}
+
+// destroyTransientDomain stops the transient domain name on conn, which
+// makes libvirt forget it.
+func destroyTransientDomain(conn *libvirt.Connect, name string) {
+	domain, err := conn.LookupDomainByName(name)
+	if err != nil {
+		log.Printf("[VirtController] Failed to look up transient domain %s: %v\n", name, err)
+		return
+	}
+	defer domain.Free()
+
+	if err := domain.Destroy(); err != nil {
+		log.Printf("[VirtController] Failed to destroy transient domain %s: %v\n", name, err)
+		return
+	}
+	log.Printf("[VirtController] Destroyed transient domain %s\n", name)
+}
+
+func (m *VirtController) runGoldenImageCleanup(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		m.deleteRetiredGoldenImages()
+	}
+}
+
+// deleteRetiredGoldenImages deletes the overlay and the state file of the
+// retired golden images no domain is restored from anymore. Instances are
+// looked up on the host rather than in the group, so that those parked in
+// a pool or still waiting to be added are found too.
+func (m *VirtController) deleteRetiredGoldenImages() {
+	m.goldenImage.Lock()
+	retired := slices.Clone(m.goldenImage.retired)
+	restoring := maps.Clone(m.goldenImage.restoring)
+	m.goldenImage.Unlock()
+
+	for _, golden := range retired {
+		if restoring[golden.id] > 0 {
+			continue
+		}
+
+		inUse, err := goldenImageInUse(golden.host, golden.id)
+		if err != nil {
+			log.Printf("[GoldenImage] Failed to check golden image %s: %v\n", golden.id, err)
+			continue
+		}
+		if inUse {
+			continue
+		}
+
+		conn := golden.host.Conn()
+		if conn == nil {
+			continue
+		}
+
+		err = genconfig.DeleteVolume(conn, golden.pool, genconfig.OverlayVolumeName(golden.id))
+		var libvirtErr libvirt.Error
+		if err != nil && !(errors.As(err, &libvirtErr) && libvirtErr.Code == libvirt.ERR_NO_STORAGE_VOL) {
+			log.Printf("[GoldenImage] Failed to delete overlay of golden image %s: %v\n", golden.id, err)
+			continue
+		}
+
+		if err := removeStateFile(golden.statePath); err != nil {
+			log.Printf("[GoldenImage] Failed to delete %s: %v\n", golden.statePath, err)
+			continue
+		}
+
+		m.goldenImage.Lock()
+		m.goldenImage.retired = slices.DeleteFunc(m.goldenImage.retired, func(r retiredGoldenImage) bool {
+			return r.id == golden.id
+		})
+		m.goldenImage.Unlock()
+
+		log.Printf("[GoldenImage] Deleted retired golden image %s\n", golden.id)
+	}
+}
+
+// removeStateFile deletes a memory state file, which is written by
+// libvirtd.
+func removeStateFile(statePath string) error {
+	cmd := exec.Command("sudo", "rm", "-f", statePath)
+	return cmd.Run()
+}
+
+// goldenImageInUse reports whether a domain on h, running or not, was
+// restored from the golden image id.
+func goldenImageInUse(h *host.Host, id string) (bool, error) {
+	conn := h.Conn()
+	if conn == nil {
+		return false, fmt.Errorf("hypervisor %s is unreachable", h.URI)
+	}
+
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return false, err
+	}
+
+	inUse := false
+	for _, domain := range domains {
+		if md, err := instance.ReadInstanceMetadata(&domain); err == nil && md.GoldenImage == id {
+			inUse = true
+		}
+		domain.Free()
+	}
+	return inUse, nil
+}
@@ -0,0 +1,291 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	genconfig "github.com/linlynnn/kvm-autoscaler/pkgs/gen-config"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+)
+
+// GroupConfig describes an instance group, a fleet of instances built from
+// the same image that is scaled by its own policies and served by its own
+// load balancer.
+type GroupConfig struct {
+	Name          string `json:"name"`
+	BaseImageName string `json:"baseImageName"`
+	// InstanceTypes are the catalog types the group launches, in order of
+	// preference, see FleetInstanceType
+	InstanceTypes []FleetInstanceType `json:"instanceTypes"`
+	// MaxMemoryMiB and MaxVcpus bound vertical scaling, instances cannot be
+	// resized when they are not above the size of their type
+	MaxMemoryMiB uint64 `json:"maxMemoryMiB"`
+	MaxVcpus     uint   `json:"maxVcpus"`
+	DiskMiB      uint64 `json:"diskMiB"`
+	// StoragePool is the libvirt pool the overlays are created in, it must
+	// hold BaseImageName as a volume on every host
+	StoragePool string `json:"storagePool"`
+	// UserDataTemplate is a cloud-init user-data template file, the embedded
+	// template is used when it is empty
+	UserDataTemplate string `json:"userDataTemplate"`
+	// DomainXMLTemplate is a domain XML template file executed with the
+	// genconfig.Domain built for each instance, the built domain is used
+	// when it is empty
+	DomainXMLTemplate string `json:"domainXMLTemplate"`
+	SSHPublicKey      string `json:"sshPublicKey"`
+	TargetPort        string `json:"targetPort"`
+	LoadBalancerURL   string `json:"loadBalancerUrl"`
+	// LoadBalancerAddress starts an in-process load balancer for the group
+	// when set
+	LoadBalancerAddress string `json:"loadBalancerAddress"`
+	// MinSize and MaxSize are in weighted capacity units, MaxSize of zero
+	// means the group is unbounded
+	MinSize int `json:"minSize"`
+	MaxSize int `json:"maxSize"`
+	// LaunchHookURL and TerminateHookURL are lifecycle webhooks, see
+	// LifecycleAction
+	LaunchHookURL    string `json:"launchHookUrl"`
+	TerminateHookURL string `json:"terminateHookUrl"`
+	// MaxLifetimeMin recycles older instances, zero keeps them forever
+	MaxLifetimeMin int `json:"maxLifetimeMin"`
+	// MaintenanceWindows limits recycling to daily ranges like
+	// "02:00-04:00,22:00-23:00", empty means any time
+	MaintenanceWindows string `json:"maintenanceWindows"`
+	// RecycleMinHealthyPercentage is the share of healthy instances an in
+	// place recycle must keep, RecycleHealthyTimeoutMin how long the
+	// replacement has to become healthy
+	RecycleMinHealthyPercentage int `json:"recycleMinHealthyPercentage"`
+	RecycleHealthyTimeoutMin    int `json:"recycleHealthyTimeoutMin"`
+	// Tags are written into the metadata of every new instance
+	Tags map[string]string `json:"tags"`
+	// Quota bounds the group alone, Tenant names a TenantQuota shared with
+	// other groups
+	Quota  Quota  `json:"quota"`
+	Tenant string `json:"tenant"`
+}
+
+// DefaultGroupConfigFromEnv builds the "default" group from the global
+// environment variables.
+func DefaultGroupConfigFromEnv() GroupConfig {
+	instanceTypes, err := ParseFleetInstanceTypes(helper.GetEnv("INSTANCE_TYPES", "medium"))
+	if err != nil {
+		log.Printf("[GroupConfig] %v, use fallback value: medium\n", err)
+		instanceTypes = []FleetInstanceType{{Type: "medium", Weight: 1}}
+	}
+
+	tags, err := instance.ParseTags(os.Getenv("INSTANCE_TAGS"))
+	if err != nil {
+		log.Printf("[GroupConfig] %v, use no tags\n", err)
+		tags = map[string]string{}
+	}
+
+	return GroupConfig{
+		Name:                        "default",
+		BaseImageName:               helper.GetEnv("BASE_IMAGE_NAME", "jammy-server-cloudimg-amd64.img"),
+		InstanceTypes:               instanceTypes,
+		MaxMemoryMiB:                uint64(helper.GetEnvInt("INSTANCE_MAX_MEMORY", 0)),
+		MaxVcpus:                    uint(helper.GetEnvInt("INSTANCE_MAX_VCPU", 0)),
+		DiskMiB:                     uint64(helper.GetEnvInt("INSTANCE_DISK_MB", 5120)),
+		StoragePool:                 genconfig.StoragePoolFromEnv(),
+		UserDataTemplate:            os.Getenv("USER_DATA_TEMPLATE"),
+		DomainXMLTemplate:           os.Getenv("DOMAIN_XML_TEMPLATE"),
+		SSHPublicKey:                os.Getenv("SSH_PUBLIC_KEY"),
+		TargetPort:                  helper.GetEnv("TARGET_PORT", "8081"),
+		LoadBalancerURL:             helper.GetEnv("LOAD_BALANCER_URL", "http://localhost:8080"),
+		MinSize:                     helper.GetEnvInt("GROUP_MIN_SIZE", 0),
+		MaxSize:                     helper.GetEnvInt("GROUP_MAX_SIZE", 0),
+		LaunchHookURL:               os.Getenv("LIFECYCLE_HOOK_LAUNCH_URL"),
+		TerminateHookURL:            os.Getenv("LIFECYCLE_HOOK_TERMINATE_URL"),
+		MaxLifetimeMin:              helper.GetEnvInt("INSTANCE_MAX_LIFETIME_MIN", 0),
+		MaintenanceWindows:          os.Getenv("MAINTENANCE_WINDOWS"),
+		RecycleMinHealthyPercentage: helper.GetEnvInt("RECYCLE_MIN_HEALTHY_PERCENTAGE", 100),
+		RecycleHealthyTimeoutMin:    helper.GetEnvInt("REFRESH_HEALTHY_TIMEOUT_MIN", 15),
+		Tags:                        tags,
+		Quota:                       QuotaFromEnv(),
+		Tenant:                      os.Getenv("GROUP_TENANT"),
+	}
+}
+
+// LoadGroupConfigs reads a JSON list of groups, unset fields fall back to
+// the default group.
+func LoadGroupConfigs(path string) ([]GroupConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	groups := []GroupConfig{}
+	names := make(map[string]bool)
+	for _, item := range raw {
+		group := DefaultGroupConfigFromEnv()
+		group.Name = ""
+		// the default types are replaced rather than merged into
+		defaultTypes := group.InstanceTypes
+		group.InstanceTypes = nil
+		if err := json.Unmarshal(item, &group); err != nil {
+			return nil, err
+		}
+		if len(group.InstanceTypes) == 0 {
+			group.InstanceTypes = defaultTypes
+		}
+
+		if err := group.Validate(); err != nil {
+			return nil, err
+		}
+
+		if names[group.Name] {
+			return nil, fmt.Errorf("group %s is defined twice", group.Name)
+		}
+		names[group.Name] = true
+		groups = append(groups, group)
+	}
+
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("%s defines no groups", path)
+	}
+	return groups, nil
+}
+
+// Validate checks the group and resolves its instance types from the
+// INSTANCE_TYPE_CATALOG.
+func (g *GroupConfig) Validate() error {
+	if g.Name == "" {
+		return fmt.Errorf("group has no name")
+	}
+
+	catalog, err := InstanceTypeCatalogFromEnv()
+	if err != nil {
+		return err
+	}
+
+	if err := g.resolveInstanceTypes(catalog); err != nil {
+		return err
+	}
+
+	if _, err := ParseMaintenanceWindows(g.MaintenanceWindows); err != nil {
+		return fmt.Errorf("group %s: %v", g.Name, err)
+	}
+
+	if g.RecycleMinHealthyPercentage < 0 || g.RecycleMinHealthyPercentage > 100 {
+		return fmt.Errorf("group %s recycle min healthy percentage %d is not between 0 and 100", g.Name, g.RecycleMinHealthyPercentage)
+	}
+
+	if g.MaxSize > 0 && g.MinSize > g.MaxSize {
+		return fmt.Errorf("group %s min size %d is above max size %d", g.Name, g.MinSize, g.MaxSize)
+	}
+
+	if err := g.validateDomain(); err != nil {
+		return fmt.Errorf("group %s: %v", g.Name, err)
+	}
+
+	return nil
+}
+
+// validateDomain renders the domain of an instance of each type, so that a
+// broken domain XML template is refused when the group is loaded rather
+// than when it scales out.
+func (g GroupConfig) validateDomain() error {
+	for _, fleetType := range g.InstanceTypes {
+		metadata, err := instanceMetadata(g, fleetType).DomainXML()
+		if err != nil {
+			return err
+		}
+
+		id := "00000000-0000-0000-0000-000000000000"
+		overlay := genconfig.OverlayVolume{Pool: g.StoragePool, Name: genconfig.OverlayVolumeName(id), Format: "qcow2"}
+		seed := genconfig.OverlayVolume{Pool: g.StoragePool, Name: genconfig.SeedVolumeName(id), Format: "raw"}
+		domain := genconfig.NewInstanceDomain(id, overlay, seed, fleetType.MemoryMiB, g.maxMemoryMiB(fleetType), fleetType.Vcpus, g.maxVcpus(fleetType), metadata)
+		if _, err := genconfig.RenderDomainXML(domain, g.DomainXMLTemplate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g GroupConfig) maxMemoryMiB(t FleetInstanceType) uint64 {
+	return max(t.MemoryMiB, g.MaxMemoryMiB)
+}
+
+func (g GroupConfig) maxVcpus(t FleetInstanceType) uint {
+	return max(t.Vcpus, g.MaxVcpus)
+}
+
+// request returns what an instance of type t needs from its host, the disk
+// covers the overlay growth in the storage pool and the cloud-init ISO.
+// Memory is the maximum, which the host counts as allocated, vCPUs are added
+// to the allocation as they are plugged.
+func (g GroupConfig) request(t FleetInstanceType) host.Request {
+	return host.Request{
+		MemoryMiB:   g.maxMemoryMiB(t),
+		Vcpus:       t.Vcpus,
+		DiskMiB:     g.DiskMiB + 1,
+		StoragePool: g.StoragePool,
+	}
+}
+
+// TemplateVersion identifies what an instance of the group is built from,
+// the base image, the instance type sizes, the cloud-init user-data and the
+// domain XML.
+// Instances of an older version are replaced by an instance refresh, weights
+// only change how instances are counted and are not part of it.
+func (g GroupConfig) TemplateVersion() string {
+	hash := sha256.New()
+	primary := g.primaryType()
+	fmt.Fprintf(hash, "%s\n%d\n%d\n%d\n%s\n", g.BaseImageName, primary.MemoryMiB, primary.Vcpus, g.DiskMiB, g.SSHPublicKey)
+	if g.MaxMemoryMiB > primary.MemoryMiB || g.MaxVcpus > primary.Vcpus {
+		// only hashed when set, so that existing instances keep their version
+		fmt.Fprintf(hash, "%d\n%d\n", g.maxMemoryMiB(primary), g.maxVcpus(primary))
+	}
+	// the primary type is hashed above in the layout from before the
+	// catalog, so that instances of a single type fleet keep their version
+	for i, fleetType := range g.InstanceTypes {
+		if i == 0 {
+			continue
+		}
+		fmt.Fprintf(hash, "%s\n%d\n%d\n", fleetType.Type, fleetType.MemoryMiB, fleetType.Vcpus)
+	}
+
+	if g.UserDataTemplate != "" {
+		userDataTemplate, err := os.ReadFile(g.UserDataTemplate)
+		if err != nil {
+			// a template that cannot be read fails the boot anyway
+			fmt.Fprintf(hash, "%s\n", g.UserDataTemplate)
+		}
+		hash.Write(userDataTemplate)
+	}
+
+	// the domain settings are only hashed when they differ from the
+	// defaults, the same as the template, so that existing instances keep
+	// their version
+	for _, setting := range [][2]string{
+		{"DOMAIN_MACHINE_TYPE", "pc"},
+		{"DOMAIN_CPU_MODE", "host-model"},
+		{"DOMAIN_CPU_MODEL", ""},
+		{"DOMAIN_NETWORK", "default"},
+	} {
+		if value := helper.GetEnv(setting[0], setting[1]); value != setting[1] {
+			fmt.Fprintf(hash, "%s=%s\n", setting[0], value)
+		}
+	}
+
+	if g.DomainXMLTemplate != "" {
+		domainXMLTemplate, err := os.ReadFile(g.DomainXMLTemplate)
+		if err != nil {
+			fmt.Fprintf(hash, "%s\n", g.DomainXMLTemplate)
+		}
+		hash.Write(domainXMLTemplate)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testGroup() GroupConfig {
+	return GroupConfig{
+		Name:          "test",
+		BaseImageName: "jammy-server-cloudimg-amd64.img",
+		InstanceTypes: []FleetInstanceType{
+			{Type: "medium", Weight: 1, InstanceType: InstanceType{Vcpus: 2, MemoryMiB: 2048}},
+		},
+	}
+}
+
+func TestTemplateVersionFollowsTheDomainXML(t *testing.T) {
+	group := testGroup()
+	version := group.TemplateVersion()
+
+	// the defaults are the settings of instances from before they were
+	// configurable
+	t.Setenv("DOMAIN_MACHINE_TYPE", "pc")
+	t.Setenv("DOMAIN_NETWORK", "default")
+	if got := group.TemplateVersion(); got != version {
+		t.Fatalf("version is %s with the default domain settings, want %s", got, version)
+	}
+
+	t.Setenv("DOMAIN_MACHINE_TYPE", "q35")
+	machineVersion := group.TemplateVersion()
+	if machineVersion == version {
+		t.Fatal("version did not change with the machine type")
+	}
+
+	group.DomainXMLTemplate = filepath.Join(t.TempDir(), "domain.xml.tmpl")
+	if err := os.WriteFile(group.DomainXMLTemplate, []byte("<domain type='kvm'/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	templateVersion := group.TemplateVersion()
+	if templateVersion == machineVersion {
+		t.Fatal("version did not change with the domain XML template")
+	}
+
+	if err := os.WriteFile(group.DomainXMLTemplate, []byte("<domain type='qemu'/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if group.TemplateVersion() == templateVersion {
+		t.Fatal("version did not change with the content of the domain XML template")
+	}
+}
+
+func TestTemplateVersionOfInstanceTypes(t *testing.T) {
+	group := testGroup()
+	version := group.TemplateVersion()
+
+	group.InstanceTypes = append(group.InstanceTypes, FleetInstanceType{Type: "large", Weight: 2, InstanceType: InstanceType{Vcpus: 4, MemoryMiB: 8192}})
+	if group.TemplateVersion() == version {
+		t.Fatal("version did not change with a second instance type")
+	}
+
+	// a group without types fails validation, its version must not panic
+	group.InstanceTypes = nil
+	group.TemplateVersion()
+}
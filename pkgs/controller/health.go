@@ -0,0 +1,264 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/lb"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// replacementLimiter bounds how many unhealthy instances are replaced in a
+// time window, so that a bad image cannot cause an endless replacement storm.
+type replacementLimiter struct {
+	sync.Mutex
+	inProgress map[string]bool
+	history    []time.Time
+}
+
+func newReplacementLimiter() *replacementLimiter {
+	return &replacementLimiter{
+		inProgress: make(map[string]bool),
+	}
+}
+
+// begin claims a replacement slot for the instance, it returns false when
+// the instance is already being replaced or the window is used up.
+func (r *replacementLimiter) begin(id string, maxReplacements int, window time.Duration) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.inProgress[id] {
+		return false
+	}
+
+	now := time.Now()
+	recent := []time.Time{}
+	for _, replacedAt := range r.history {
+		if now.Sub(replacedAt) < window {
+			recent = append(recent, replacedAt)
+		}
+	}
+	r.history = recent
+
+	if len(r.history) >= maxReplacements {
+		return false
+	}
+
+	r.history = append(r.history, now)
+	r.inProgress[id] = true
+	return true
+}
+
+func (r *replacementLimiter) end(id string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.inProgress, id)
+}
+
+func (r *replacementLimiter) isReplacing(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.inProgress[id]
+}
+
+func (m *VirtController) runHealthReplacement(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		maxReplacements := helper.GetEnvInt("HEALTH_REPLACEMENT_MAX", 3)
+		window := time.Duration(helper.GetEnvInt("HEALTH_REPLACEMENT_WINDOW_MIN", 10)) * time.Minute
+
+		for _, inst := range m.findUnhealthyInstances() {
+			if m.replacement.isReplacing(inst.GetID()) {
+				continue
+			}
+
+			if !m.replacement.begin(inst.GetID(), maxReplacements, window) {
+				log.Printf("[VirtController] Replacement limit %d per %v reached, keep unhealthy %s\n", maxReplacements, window, inst.GetID())
+				break
+			}
+
+			go m.replaceInstance(inst)
+		}
+	}
+}
+
+// onDomainEvent reacts to instances that crashed, or that were stopped or
+// undefined outside the autoscaler, without waiting for the next health
+// check.
+func (m *VirtController) onDomainEvent(event host.DomainEvent) {
+	m.Lock()
+	inst, ok := m.MapInstanceIdToInstance[event.Name]
+	terminating := m.terminating[event.Name]
+	m.Unlock()
+
+	if !ok || terminating {
+		return
+	}
+
+	switch {
+	case event.Undefined:
+		log.Printf("[VirtController] %s was undefined outside the autoscaler\n", inst.GetID())
+	case event.Crashed():
+		log.Printf("[VirtController] %s crashed\n", inst.GetID())
+	case event.Event == libvirt.DOMAIN_EVENT_STOPPED:
+		log.Printf("[VirtController] %s was stopped outside the autoscaler\n", inst.GetID())
+	default:
+		return
+	}
+
+	if !helper.GetEnvBool("HEALTH_REPLACEMENT_ENABLED", true) {
+		return
+	}
+
+	if !event.Undefined && inst.IsScaleInProtected() && !helper.GetEnvBool("HEALTH_REPLACEMENT_PROTECTED", false) {
+		log.Printf("[VirtController] %s is protected, keep it\n", inst.GetID())
+		return
+	}
+
+	maxReplacements := helper.GetEnvInt("HEALTH_REPLACEMENT_MAX", 3)
+	window := time.Duration(helper.GetEnvInt("HEALTH_REPLACEMENT_WINDOW_MIN", 10)) * time.Minute
+	if !m.replacement.begin(inst.GetID(), maxReplacements, window) {
+		log.Printf("[VirtController] Replacement limit %d per %v reached, keep %s\n", maxReplacements, window, inst.GetID())
+		return
+	}
+
+	// the event loop must not block
+	if event.Undefined {
+		go m.replaceMissingInstance(inst)
+	} else {
+		go m.replaceInstance(inst)
+	}
+}
+
+// findUnhealthyInstances returns instances that fail the load balancer
+// health check, or that crashed, got paused or shut off in libvirt.
+func (m *VirtController) findUnhealthyInstances() []instance.InstanceManager {
+	unhealthyBackends := make(map[string]bool)
+	if m.hasLoadBalancer() {
+		backendURLs, err := m.getUnhealthyBackends()
+		if err != nil {
+			log.Printf("[VirtController] Failed to get unhealthy backends: %v\n", err)
+		}
+
+		for _, backendURL := range backendURLs {
+			unhealthyBackends[backendURL] = true
+		}
+	}
+
+	// protected instances are kept for debugging unless replacing them is
+	// explicitly allowed
+	replaceProtected := helper.GetEnvBool("HEALTH_REPLACEMENT_PROTECTED", false)
+	unhealthyInstances := []instance.InstanceManager{}
+
+	// the instances are copied so that the libvirt calls below do not hold
+	// the lock. Terminating instances are shut off on purpose.
+	instances := []instance.InstanceManager{}
+	m.Lock()
+	for id, instanceMng := range m.MapInstanceIdToInstance {
+		if !m.terminating[id] {
+			instances = append(instances, instanceMng)
+		}
+	}
+	m.Unlock()
+
+	for _, instanceMng := range instances {
+		// the state of an unreachable hypervisor is unknown, not unhealthy
+		if !m.isHostConnected(instanceMng) {
+			continue
+		}
+
+		if instanceMng.IsScaleInProtected() && !replaceProtected {
+			continue
+		}
+
+		// pooled instances are parked on purpose but never in the map, a
+		// suspended, saved or shut off instance here does not serve its
+		// traffic
+		status := instanceMng.GetStatus()
+		switch status {
+		case instance.VM_STATE_CRASHED, instance.VM_STATE_PAUSED, instance.VM_STATE_SUSPENDED, instance.VM_STATE_SAVED, instance.VM_STATE_SHUT_OFF:
+			log.Printf("[VirtController] %s is unhealthy, libvirt state %d\n", instanceMng.GetID(), status)
+			unhealthyInstances = append(unhealthyInstances, instanceMng)
+			continue
+		}
+
+		if unhealthyBackends[instanceMng.GetBackendURL()] {
+			log.Printf("[VirtController] %s is unhealthy, failed load balancer health check\n", instanceMng.GetID())
+			unhealthyInstances = append(unhealthyInstances, instanceMng)
+		}
+	}
+
+	return unhealthyInstances
+}
+
+func (m *VirtController) getUnhealthyBackends() ([]string, error) {
+	resp, err := http.Get(m.getGroup().LoadBalancerURL + "/backend?status=unhealthy")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var backends []lb.BackendResponse
+	if err := json.NewDecoder(resp.Body).Decode(&backends); err != nil {
+		return nil, err
+	}
+
+	backendURLs := []string{}
+	for _, backend := range backends {
+		backendURLs = append(backendURLs, backend.URL)
+	}
+	return backendURLs, nil
+}
+
+// replaceInstance terminates an unhealthy instance and launches a fresh one
+// in its place, regardless of the scaling cooldowns.
+func (m *VirtController) replaceInstance(inst instance.InstanceManager) {
+	defer m.replacement.end(inst.GetID())
+
+	log.Printf("[VirtController] Replacing unhealthy %s\n", inst.GetID())
+	if err := m.terminate(inst, false); err != nil {
+		log.Printf("[VirtController] Failed to terminate unhealthy %s: %v\n", inst.GetID(), err)
+		return
+	}
+
+	m.launchReplacement(inst)
+}
+
+// replaceMissingInstance forgets an instance whose domain no longer exists
+// and launches a fresh one in its place.
+func (m *VirtController) replaceMissingInstance(inst instance.InstanceManager) {
+	defer m.replacement.end(inst.GetID())
+
+	log.Printf("[VirtController] Replacing missing %s\n", inst.GetID())
+	if m.hasLoadBalancer() {
+		inst.DeRegisterIP(m.getGroup().LoadBalancerURL)
+	}
+	inst.DeRegisterPromDiscovery()
+
+	m.Lock()
+	delete(m.MapInstanceIdToInstance, inst.GetID())
+	m.Unlock()
+
+	m.launchReplacement(inst)
+}
+
+func (m *VirtController) launchReplacement(inst instance.InstanceManager) {
+	h, fleetType, err := m.placeLike(inst)
+	if err != nil {
+		log.Printf("[VirtController] Failed to place replacement of %s: %v\n", inst.GetID(), err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	m.createVM(h, fleetType, &wg)
+	log.Printf("[VirtController] Replaced %s\n", inst.GetID())
+}
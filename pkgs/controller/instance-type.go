@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+)
+
+// InstanceType is a named instance size of the catalog.
+type InstanceType struct {
+	Name      string `json:"name"`
+	Vcpus     uint   `json:"vcpus"`
+	MemoryMiB uint64 `json:"memoryMiB"`
+}
+
+// FleetInstanceType is an instance type a group may launch. Weight is the
+// capacity one instance of the type counts for, group sizes and scaling
+// are in these units instead of instances.
+type FleetInstanceType struct {
+	Type   string `json:"type"`
+	Weight int    `json:"weight"`
+	// resolved from the catalog
+	InstanceType `json:"-"`
+}
+
+// InstanceTypeCatalogFromEnv parses INSTANCE_TYPE_CATALOG, a list like
+// "small=1/1024,large=4/8192" of vCPUs and memory in MiB.
+func InstanceTypeCatalogFromEnv() (map[string]InstanceType, error) {
+	catalog := make(map[string]InstanceType)
+	value := helper.GetEnv("INSTANCE_TYPE_CATALOG", "small=1/1024,medium=2/2048,large=4/8192")
+
+	for _, item := range strings.Split(value, ",") {
+		name, size, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("instance type %q is not name=vcpus/memoryMiB", item)
+		}
+
+		vcpus, memory, ok := strings.Cut(size, "/")
+		if !ok {
+			return nil, fmt.Errorf("instance type %q is not name=vcpus/memoryMiB", item)
+		}
+
+		parsedVcpus, err := strconv.ParseUint(vcpus, 10, 32)
+		if err != nil || parsedVcpus == 0 {
+			return nil, fmt.Errorf("instance type %s has invalid vcpus %q", name, vcpus)
+		}
+
+		parsedMemory, err := strconv.ParseUint(memory, 10, 64)
+		if err != nil || parsedMemory == 0 {
+			return nil, fmt.Errorf("instance type %s has invalid memory %q", name, memory)
+		}
+
+		catalog[name] = InstanceType{
+			Name:      name,
+			Vcpus:     uint(parsedVcpus),
+			MemoryMiB: parsedMemory,
+		}
+	}
+
+	return catalog, nil
+}
+
+// ParseFleetInstanceTypes parses a list like "large:4,small:1" of instance
+// types and their weights, the weight defaults to 1.
+func ParseFleetInstanceTypes(value string) ([]FleetInstanceType, error) {
+	fleet := []FleetInstanceType{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, weight, hasWeight := strings.Cut(item, ":")
+		fleetType := FleetInstanceType{Type: name, Weight: 1}
+		if hasWeight {
+			parsed, err := strconv.Atoi(weight)
+			if err != nil {
+				return nil, fmt.Errorf("instance type %s has invalid weight %q", name, weight)
+			}
+			fleetType.Weight = parsed
+		}
+		fleet = append(fleet, fleetType)
+	}
+
+	return fleet, nil
+}
+
+// resolveInstanceTypes looks the fleet types of the group up in catalog.
+func (g *GroupConfig) resolveInstanceTypes(catalog map[string]InstanceType) error {
+	if len(g.InstanceTypes) == 0 {
+		return fmt.Errorf("group %s has no instance types", g.Name)
+	}
+
+	for i, fleetType := range g.InstanceTypes {
+		instanceType, ok := catalog[fleetType.Type]
+		if !ok {
+			return fmt.Errorf("group %s uses unknown instance type %s", g.Name, fleetType.Type)
+		}
+
+		if fleetType.Weight == 0 {
+			g.InstanceTypes[i].Weight = 1
+		} else if fleetType.Weight < 0 {
+			return fmt.Errorf("group %s gives instance type %s weight %d, it must be at least 1", g.Name, fleetType.Type, fleetType.Weight)
+		}
+		g.InstanceTypes[i].InstanceType = instanceType
+	}
+
+	return nil
+}
+
+// primaryType is the first instance type of the group, the golden image and
+// the warm pools are built from it. It is empty for a group without types,
+// which fails validation.
+func (g GroupConfig) primaryType() FleetInstanceType {
+	if len(g.InstanceTypes) == 0 {
+		return FleetInstanceType{}
+	}
+	return g.InstanceTypes[0]
+}
+
+// instanceType returns the fleet type called name, which is gone when the
+// group was updated since the instance was launched.
+func (g GroupConfig) instanceType(name string) (FleetInstanceType, bool) {
+	for _, fleetType := range g.InstanceTypes {
+		if fleetType.Type == name {
+			return fleetType, true
+		}
+	}
+	return FleetInstanceType{}, false
+}
+
+// typeOf returns the fleet type of inst, instances of a type the group no
+// longer launches are treated as the primary type.
+func (g GroupConfig) typeOf(inst instance.InstanceManager) FleetInstanceType {
+	if fleetType, ok := g.instanceType(inst.GetInstanceType()); ok {
+		return fleetType
+	}
+	return g.primaryType()
+}
+
+// launchOrder returns the instance types to try for the remaining units,
+// the heaviest type that does not overshoot first, so that the smaller
+// types fill what is left on the hosts.
+func (g GroupConfig) launchOrder(remaining int) []FleetInstanceType {
+	fitting := []FleetInstanceType{}
+	overshooting := []FleetInstanceType{}
+	for _, fleetType := range g.InstanceTypes {
+		if fleetType.Weight <= remaining {
+			fitting = append(fitting, fleetType)
+		} else {
+			overshooting = append(overshooting, fleetType)
+		}
+	}
+
+	slices.SortStableFunc(fitting, func(a, b FleetInstanceType) int {
+		return b.Weight - a.Weight
+	})
+	slices.SortStableFunc(overshooting, func(a, b FleetInstanceType) int {
+		return a.Weight - b.Weight
+	})
+	return append(fitting, overshooting...)
+}
+
+func capacityOf(instances []instance.InstanceManager) int {
+	capacity := 0
+	for _, inst := range instances {
+		capacity += inst.GetWeight()
+	}
+	return capacity
+}
+
+// place finds a host for the next launch of the remaining units and
+// reserves room for it there.
+func (m *VirtController) place(group GroupConfig, remaining int) (*host.Host, FleetInstanceType, error) {
+	var lastErr error
+	for _, fleetType := range group.launchOrder(remaining) {
+		h, err := m.placeInstance(group, fleetType)
+		if err == nil {
+			return h, fleetType, nil
+		}
+		lastErr = err
+	}
+
+	return nil, FleetInstanceType{}, lastErr
+}
+
+// placeLike finds a host for an instance that replaces inst, of the same
+// type when there is room for it and of the same weight otherwise.
+func (m *VirtController) placeLike(inst instance.InstanceManager) (*host.Host, FleetInstanceType, error) {
+	group := m.getGroup()
+	fleetType := group.typeOf(inst)
+	if h, err := m.placeInstance(group, fleetType); err == nil {
+		return h, fleetType, nil
+	}
+
+	return m.place(group, fleetType.Weight)
+}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+)
+
+type LaunchState string
+
+const (
+	// the launch waits for a free slot or for its host to be ready
+	LAUNCH_STATE_QUEUED LaunchState = "queued"
+	// the disk images are generated and the domain boots
+	LAUNCH_STATE_LAUNCHING LaunchState = "launching"
+)
+
+// PendingLaunch is an instance creation that has not finished yet.
+type PendingLaunch struct {
+	ID       int         `json:"id"`
+	Group    string      `json:"group"`
+	Host     string      `json:"host"`
+	State    LaunchState `json:"state"`
+	QueuedAt time.Time   `json:"queuedAt"`
+}
+
+// LaunchQueue bounds how many instances are created at once and staggers
+// the creations on each host, so that a large scale-up does not saturate the
+// host disks with qemu-img and cloud-localds runs. It is shared by the
+// groups placed on the same hosts.
+type LaunchQueue struct {
+	sync.Mutex
+	slots chan struct{}
+	// HostInterval is the minimum time between two launches on a host
+	HostInterval time.Duration
+	// Jitter is the maximum random delay added to every launch
+	Jitter    time.Duration
+	nextStart map[string]time.Time
+	pending   map[int]*PendingLaunch
+	nextID    int
+}
+
+func NewLaunchQueue(maxParallel int, hostInterval time.Duration, jitter time.Duration) *LaunchQueue {
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+
+	return &LaunchQueue{
+		slots:        make(chan struct{}, maxParallel),
+		HostInterval: hostInterval,
+		Jitter:       jitter,
+		nextStart:    make(map[string]time.Time),
+		pending:      make(map[int]*PendingLaunch),
+	}
+}
+
+func LaunchQueueFromEnv() *LaunchQueue {
+	return NewLaunchQueue(
+		helper.GetEnvInt("LAUNCH_MAX_PARALLEL", 4),
+		time.Duration(helper.GetEnvInt("LAUNCH_HOST_INTERVAL_SEC", 5))*time.Second,
+		time.Duration(helper.GetEnvInt("LAUNCH_JITTER_MS", 2000))*time.Millisecond,
+	)
+}
+
+// acquire blocks until a launch for group on hostURI may start, the
+// returned id must be given back to release.
+func (q *LaunchQueue) acquire(group string, hostURI string) int {
+	q.Lock()
+	q.nextID++
+	id := q.nextID
+	q.pending[id] = &PendingLaunch{
+		ID:       id,
+		Group:    group,
+		Host:     hostURI,
+		State:    LAUNCH_STATE_QUEUED,
+		QueuedAt: time.Now(),
+	}
+	q.Unlock()
+
+	q.slots <- struct{}{}
+
+	q.Lock()
+	now := time.Now()
+	start := now
+	if q.nextStart[hostURI].After(now) {
+		start = q.nextStart[hostURI]
+	}
+	q.nextStart[hostURI] = start.Add(q.HostInterval)
+	q.Unlock()
+
+	wait := start.Sub(now)
+	if q.Jitter > 0 {
+		wait += rand.N(q.Jitter)
+	}
+
+	if wait > 0 {
+		log.Printf("[LaunchQueue] Launch %d on %s starts in %v\n", id, hostURI, wait)
+		time.Sleep(wait)
+	}
+
+	q.Lock()
+	q.pending[id].State = LAUNCH_STATE_LAUNCHING
+	q.Unlock()
+
+	return id
+}
+
+func (q *LaunchQueue) release(id int) {
+	q.Lock()
+	delete(q.pending, id)
+	q.Unlock()
+
+	<-q.slots
+}
+
+// Pending returns the queued and running launches of group, oldest first.
+func (q *LaunchQueue) Pending(group string) []PendingLaunch {
+	q.Lock()
+	defer q.Unlock()
+
+	pending := []PendingLaunch{}
+	for _, launch := range q.pending {
+		if launch.Group == group {
+			pending = append(pending, *launch)
+		}
+	}
+
+	slices.SortFunc(pending, func(a, b PendingLaunch) int {
+		return a.ID - b.ID
+	})
+	return pending
+}
+
+// GetPendingLaunches lets policies account for instances that are on their
+// way, so that a slow scale-up is not repeated.
+func (m *VirtController) GetPendingLaunches() []PendingLaunch {
+	return m.launchQueue.Pending(m.getGroup().Name)
+}
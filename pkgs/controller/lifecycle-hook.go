@@ -0,0 +1,198 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+)
+
+type LifecycleTransition string
+
+const (
+	// the instance is up but not yet registered with the load balancer
+	LIFECYCLE_TRANSITION_LAUNCHING LifecycleTransition = "pending:wait"
+	// the instance is drained but not yet shut down
+	LIFECYCLE_TRANSITION_TERMINATING LifecycleTransition = "terminating:wait"
+)
+
+type LifecycleResult string
+
+const (
+	LIFECYCLE_RESULT_CONTINUE LifecycleResult = "CONTINUE"
+	// an abandoned launch is terminated, an abandoned termination is not
+	// returned to the warm pool
+	LIFECYCLE_RESULT_ABANDON LifecycleResult = "ABANDON"
+)
+
+// LifecycleAction is sent to the webhook. The webhook completes it right
+// away by answering 200 with a LifecycleCompletion, or later through the
+// admin API with the token when it answers 202.
+type LifecycleAction struct {
+	Token      string              `json:"token"`
+	Group      string              `json:"group"`
+	InstanceID string              `json:"instanceId"`
+	Host       string              `json:"host"`
+	Transition LifecycleTransition `json:"transition"`
+	Deadline   time.Time           `json:"deadline"`
+}
+
+type LifecycleCompletion struct {
+	Token  string          `json:"token"`
+	Result LifecycleResult `json:"result"`
+}
+
+// lifecycleHooks holds the actions that wait for their webhook to complete.
+type lifecycleHooks struct {
+	sync.Mutex
+	pending map[string]*pendingLifecycleAction
+}
+
+type pendingLifecycleAction struct {
+	action LifecycleAction
+	result chan LifecycleResult
+}
+
+func newLifecycleHooks() *lifecycleHooks {
+	return &lifecycleHooks{
+		pending: make(map[string]*pendingLifecycleAction),
+	}
+}
+
+// hookURL returns the webhook configured for the transition, no hook runs
+// when it is empty.
+func (g GroupConfig) hookURL(transition LifecycleTransition) string {
+	if transition == LIFECYCLE_TRANSITION_LAUNCHING {
+		return g.LaunchHookURL
+	}
+	return g.TerminateHookURL
+}
+
+// runLifecycleHook calls the webhook of the transition and blocks until the
+// action completes or LIFECYCLE_HOOK_TIMEOUT_SEC passes, which resolves to
+// LIFECYCLE_HOOK_DEFAULT_RESULT.
+func (m *VirtController) runLifecycleHook(inst instance.InstanceManager, transition LifecycleTransition) LifecycleResult {
+	group := m.getGroup()
+	hookURL := group.hookURL(transition)
+	if hookURL == "" {
+		return LIFECYCLE_RESULT_CONTINUE
+	}
+
+	timeout := time.Duration(helper.GetEnvInt("LIFECYCLE_HOOK_TIMEOUT_SEC", 300)) * time.Second
+	defaultResult := LifecycleResult(helper.GetEnv("LIFECYCLE_HOOK_DEFAULT_RESULT", string(LIFECYCLE_RESULT_CONTINUE)))
+	if defaultResult != LIFECYCLE_RESULT_CONTINUE && defaultResult != LIFECYCLE_RESULT_ABANDON {
+		log.Printf("[LifecycleHook] Unknown default result %s, use fallback value: %s\n", defaultResult, LIFECYCLE_RESULT_CONTINUE)
+		defaultResult = LIFECYCLE_RESULT_CONTINUE
+	}
+
+	pending := &pendingLifecycleAction{
+		action: LifecycleAction{
+			Token:      uuid.New().String(),
+			Group:      group.Name,
+			InstanceID: inst.GetID(),
+			Host:       inst.GetHost(),
+			Transition: transition,
+			Deadline:   time.Now().Add(timeout),
+		},
+		result: make(chan LifecycleResult, 1),
+	}
+
+	m.hooks.Lock()
+	m.hooks.pending[pending.action.Token] = pending
+	m.hooks.Unlock()
+	defer func() {
+		m.hooks.Lock()
+		delete(m.hooks.pending, pending.action.Token)
+		m.hooks.Unlock()
+	}()
+
+	log.Printf("[LifecycleHook] %s is in %s\n", inst.GetID(), transition)
+	if result, done, err := callLifecycleWebhook(hookURL, pending.action); err != nil {
+		log.Printf("[LifecycleHook] Webhook of %s failed, use %s: %v\n", inst.GetID(), defaultResult, err)
+		return defaultResult
+	} else if done {
+		log.Printf("[LifecycleHook] %s completed %s with %s\n", inst.GetID(), transition, result)
+		return result
+	}
+
+	select {
+	case result := <-pending.result:
+		log.Printf("[LifecycleHook] %s completed %s with %s\n", inst.GetID(), transition, result)
+		return result
+	case <-time.After(timeout):
+		log.Printf("[LifecycleHook] %s timed out in %s after %v, use %s\n", inst.GetID(), transition, timeout, defaultResult)
+		return defaultResult
+	}
+}
+
+// callLifecycleWebhook posts the action, done is true when the webhook
+// answered with the result instead of accepting the action for later.
+func callLifecycleWebhook(hookURL string, action LifecycleAction) (LifecycleResult, bool, error) {
+	jsonData, err := json.Marshal(action)
+	if err != nil {
+		return "", false, err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(hookURL, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return "", false, nil
+	case http.StatusOK:
+		var completion LifecycleCompletion
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			return "", false, err
+		}
+		if completion.Result != LIFECYCLE_RESULT_CONTINUE && completion.Result != LIFECYCLE_RESULT_ABANDON {
+			return "", false, fmt.Errorf("unknown result %q", completion.Result)
+		}
+		return completion.Result, true, nil
+	}
+
+	return "", false, fmt.Errorf("webhook answered %s", resp.Status)
+}
+
+// CompleteLifecycleAction resumes the instance waiting on token.
+func (m *VirtController) CompleteLifecycleAction(token string, result LifecycleResult) error {
+	if result != LIFECYCLE_RESULT_CONTINUE && result != LIFECYCLE_RESULT_ABANDON {
+		return fmt.Errorf("unknown result %q", result)
+	}
+
+	m.hooks.Lock()
+	pending, ok := m.hooks.pending[token]
+	m.hooks.Unlock()
+	if !ok {
+		return fmt.Errorf("no lifecycle action %s is pending", token)
+	}
+
+	select {
+	case pending.result <- result:
+		return nil
+	default:
+		return fmt.Errorf("lifecycle action %s is already completed", token)
+	}
+}
+
+// GetPendingLifecycleActions returns the instances waiting on a hook.
+func (m *VirtController) GetPendingLifecycleActions() []LifecycleAction {
+	m.hooks.Lock()
+	defer m.hooks.Unlock()
+
+	actions := []LifecycleAction{}
+	for _, pending := range m.hooks.pending {
+		actions = append(actions, pending.action)
+	}
+	return actions
+}
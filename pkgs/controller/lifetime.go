@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+)
+
+// MaintenanceWindow is a daily time range in local time, it may wrap past
+// midnight.
+type MaintenanceWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseMaintenanceWindows parses a comma separated list like
+// "02:00-04:00,22:30-23:30".
+func ParseMaintenanceWindows(value string) ([]MaintenanceWindow, error) {
+	windows := []MaintenanceWindow{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		startValue, endValue, ok := strings.Cut(item, "-")
+		if !ok {
+			return nil, fmt.Errorf("maintenance window %q is not HH:MM-HH:MM", item)
+		}
+
+		start, err := parseTimeOfDay(startValue)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(endValue)
+		if err != nil {
+			return nil, err
+		}
+
+		windows = append(windows, MaintenanceWindow{Start: start, End: end})
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w MaintenanceWindow) contains(now time.Time) bool {
+	year, month, day := now.Date()
+	sinceMidnight := now.Sub(time.Date(year, month, day, 0, 0, 0, 0, now.Location()))
+
+	if w.Start <= w.End {
+		return sinceMidnight >= w.Start && sinceMidnight < w.End
+	}
+	return sinceMidnight >= w.Start || sinceMidnight < w.End
+}
+
+// inMaintenanceWindow is true when no window is configured.
+func inMaintenanceWindow(windows []MaintenanceWindow, now time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+
+	for _, window := range windows {
+		if window.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// runLifetimeRecycling replaces instances older than the max lifetime of the
+// group, one at a time and inside the maintenance windows.
+func (m *VirtController) runLifetimeRecycling(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		group := m.getGroup()
+		if group.MaxLifetimeMin <= 0 {
+			continue
+		}
+
+		windows, err := ParseMaintenanceWindows(group.MaintenanceWindows)
+		if err != nil {
+			log.Printf("[Recycle] Invalid maintenance windows of group %s: %v\n", group.Name, err)
+			continue
+		}
+
+		if !inMaintenanceWindow(windows, time.Now()) {
+			continue
+		}
+
+		if m.refresh.get().State == REFRESH_STATE_IN_PROGRESS {
+			continue
+		}
+
+		inst := m.findExpiredInstance(time.Duration(group.MaxLifetimeMin) * time.Minute)
+		if inst == nil {
+			continue
+		}
+
+		if err := m.recycleInstance(group, inst); err != nil {
+			log.Printf("[Recycle] Failed to recycle %s: %v\n", inst.GetID(), err)
+		}
+	}
+}
+
+// findExpiredInstance returns the oldest running instance over maxLifetime
+// that nothing else is replacing.
+func (m *VirtController) findExpiredInstance(maxLifetime time.Duration) instance.InstanceManager {
+	_, runningInstances, _ := m.GetRunningInstance()
+
+	slices.SortFunc(runningInstances, func(a, b instance.InstanceManager) int {
+		return a.GetBootTime().Compare(b.GetBootTime())
+	})
+
+	for _, inst := range runningInstances {
+		if time.Since(inst.GetBootTime()) < maxLifetime {
+			break
+		}
+
+		m.Lock()
+		terminating := m.terminating[inst.GetID()]
+		m.Unlock()
+		if terminating || m.replacement.isReplacing(inst.GetID()) || !m.isHostConnected(inst) || inst.IsScaleInProtected() {
+			continue
+		}
+		return inst
+	}
+	return nil
+}
+
+// recycleInstance launches the replacement first and waits for it to be
+// healthy before draining the expired instance. When there is no room for
+// an extra instance it is replaced in place, as long as the healthy
+// instances stay above the RecycleMinHealthyPercentage of group.
+func (m *VirtController) recycleInstance(group GroupConfig, inst instance.InstanceManager) error {
+	minHealthyPercentage := group.RecycleMinHealthyPercentage
+	healthyTimeout := time.Duration(group.RecycleHealthyTimeoutMin) * time.Minute
+
+	healthy, running, err := m.countHealthy()
+	if err != nil {
+		return err
+	}
+
+	minHealthy := (running*minHealthyPercentage + 99) / 100
+	if healthy < minHealthy {
+		return fmt.Errorf("only %d of %d instances are healthy, %d required", healthy, running, minHealthy)
+	}
+
+	log.Printf("[Recycle] %s reached its max lifetime, booted %v\n", inst.GetID(), inst.GetBootTime().Format(time.RFC3339))
+
+	newInstances, err := m.launchBatch(group, inst.GetWeight())
+	if err != nil {
+		for _, newInstance := range newInstances {
+			m.terminate(newInstance, false)
+		}
+
+		if healthy-1 < minHealthy {
+			return fmt.Errorf("no room for a replacement and replacing in place would leave %d healthy: %v", healthy-1, err)
+		}
+
+		log.Printf("[Recycle] No room for a replacement, recycle %s in place: %v\n", inst.GetID(), err)
+		if err := m.terminate(inst, false); err != nil {
+			return err
+		}
+
+		newInstances, err = m.launchBatch(group, inst.GetWeight())
+		if err != nil {
+			// the expired instance is gone, what did not start is retried
+			// rather than left missing from the group
+			if lost := inst.GetWeight() - capacityOf(newInstances); lost > 0 {
+				m.relaunchCapacity(group, lost)
+			}
+			return err
+		}
+		return m.waitForHealthy(newInstances, healthyTimeout)
+	}
+
+	if err := m.waitForHealthy(newInstances, healthyTimeout); err != nil {
+		for _, newInstance := range newInstances {
+			m.terminate(newInstance, false)
+		}
+		return err
+	}
+
+	if err := m.terminate(inst, false); err != nil {
+		return err
+	}
+
+	log.Printf("[Recycle] Recycled %s\n", inst.GetID())
+	return nil
+}
+
+// countHealthy returns the running instances that are alive in the load
+// balancer, all running instances count when the group has none.
+func (m *VirtController) countHealthy() (int, int, error) {
+	running, runningInstances, _ := m.GetRunningInstance()
+	if !m.hasLoadBalancer() {
+		return running, running, nil
+	}
+
+	backendURLs, err := m.getAliveBackends()
+	if err != nil {
+		return 0, running, err
+	}
+
+	healthy := 0
+	for _, inst := range runningInstances {
+		if slices.Contains(backendURLs, inst.GetBackendURL()) {
+			healthy++
+		}
+	}
+	return healthy, running, nil
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// instanceMetadata describes a new instance of fleetType in group.
+func instanceMetadata(group GroupConfig, fleetType FleetInstanceType) instance.InstanceMetadata {
+	md := instance.InstanceMetadata{
+		Group:           group.Name,
+		TemplateVersion: group.TemplateVersion(),
+		InstanceType:    fleetType.Type,
+		Weight:          fleetType.Weight,
+		CreatedAt:       time.Now().UTC(),
+		AutoscalerID:    instance.AutoscalerIDFromEnv(),
+	}
+	md.SetTags(group.Tags)
+	return md
+}
+
+// adoptInstances takes over the running domains on h that this autoscaler
+// created for the group before it restarted. Domains in other states are
+// left alone, parked pool instances are not adopted back into their pool.
+// It reports whether the domains of h could be listed.
+func (m *VirtController) adoptInstances(h *host.Host) bool {
+	conn := h.Conn()
+	if conn == nil {
+		return false
+	}
+
+	domains, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_RUNNING)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	group := m.getGroup()
+	autoscalerID := instance.AutoscalerIDFromEnv()
+	for _, domain := range domains {
+		md, err := instance.ReadInstanceMetadata(&domain)
+		if err != nil || md.Group != group.Name || md.AutoscalerID != autoscalerID {
+			domain.Free()
+			continue
+		}
+
+		name, err := domain.GetName()
+		if err != nil {
+			domain.Free()
+			continue
+		}
+
+		m.Lock()
+		_, known := m.MapInstanceIdToInstance[name]
+		m.Unlock()
+		if known {
+			domain.Free()
+			continue
+		}
+
+		instanceMng := instance.AdoptVirtInstanceManager(&domain, name, h.URI, group.TargetPort, md)
+		instanceMng.WatchState(h)
+
+		m.Lock()
+		m.MapInstanceIdToInstance[name] = instanceMng
+		m.Unlock()
+
+		log.Printf("[VirtController] Adopted %s of group %s on %s, created %v\n", name, group.Name, h.URI, md.CreatedAt.Format(time.RFC3339))
+		m.registerInstance(instanceMng)
+	}
+	return true
+}
+
+// SetInstanceTag adds, changes or with an empty value removes a tag of the
+// instance.
+func (m *VirtController) SetInstanceTag(instanceID string, key string, value string) error {
+	m.Lock()
+	inst, ok := m.MapInstanceIdToInstance[instanceID]
+	m.Unlock()
+	if !ok {
+		return fmt.Errorf("instance %s is not in group %s", instanceID, m.getGroup().Name)
+	}
+
+	return inst.SetTag(key, value)
+}
+
+// SelectInstancesByTag returns the running instances tagged key=value, any
+// value matches when value is empty.
+func (m *VirtController) SelectInstancesByTag(key string, value string) []instance.InstanceManager {
+	_, runningInstances, _ := m.GetRunningInstance()
+
+	selected := []instance.InstanceManager{}
+	for _, inst := range runningInstances {
+		tagValue, ok := inst.GetTags()[key]
+		if ok && (value == "" || tagValue == value) {
+			selected = append(selected, inst)
+		}
+	}
+	return selected
+}
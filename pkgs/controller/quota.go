@@ -0,0 +1,287 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
+)
+
+// Quota bounds what a group or a tenant may hold on the shared hypervisors,
+// so that one runaway policy cannot starve the other teams. Zero fields are
+// unlimited.
+type Quota struct {
+	MaxVcpus     int64 `json:"maxVcpus"`
+	MaxMemoryMiB int64 `json:"maxMemoryMiB"`
+	MaxDiskMiB   int64 `json:"maxDiskMiB"`
+	MaxInstances int64 `json:"maxInstances"`
+}
+
+// QuotaUsage counts the instances of the group, parked pool instances and
+// launches in flight included. Memory is the hot-plug maximum, the host
+// holds it for the instance.
+type QuotaUsage struct {
+	Vcpus     int64 `json:"vcpus"`
+	MemoryMiB int64 `json:"memoryMiB"`
+	DiskMiB   int64 `json:"diskMiB"`
+	Instances int64 `json:"instances"`
+}
+
+// QuotaStatus is the quota of a group or tenant and how much of it is used,
+// Remaining is -1 for unlimited fields.
+type QuotaStatus struct {
+	Scope     string     `json:"scope"`
+	Name      string     `json:"name"`
+	Quota     Quota      `json:"quota"`
+	Usage     QuotaUsage `json:"usage"`
+	Remaining QuotaUsage `json:"remaining"`
+}
+
+const (
+	QUOTA_SCOPE_GROUP  = "group"
+	QUOTA_SCOPE_TENANT = "tenant"
+)
+
+func QuotaFromEnv() Quota {
+	return Quota{
+		MaxVcpus:     int64(helper.GetEnvInt("QUOTA_MAX_VCPUS", 0)),
+		MaxMemoryMiB: int64(helper.GetEnvInt("QUOTA_MAX_MEMORY_MIB", 0)),
+		MaxDiskMiB:   int64(helper.GetEnvInt("QUOTA_MAX_DISK_MIB", 0)),
+		MaxInstances: int64(helper.GetEnvInt("QUOTA_MAX_INSTANCES", 0)),
+	}
+}
+
+func usageOf(req host.Request) QuotaUsage {
+	return QuotaUsage{
+		Vcpus:     int64(req.Vcpus),
+		MemoryMiB: int64(req.MemoryMiB),
+		DiskMiB:   int64(req.DiskMiB),
+		Instances: 1,
+	}
+}
+
+func (u QuotaUsage) add(other QuotaUsage) QuotaUsage {
+	return QuotaUsage{
+		Vcpus:     u.Vcpus + other.Vcpus,
+		MemoryMiB: u.MemoryMiB + other.MemoryMiB,
+		DiskMiB:   u.DiskMiB + other.DiskMiB,
+		Instances: u.Instances + other.Instances,
+	}
+}
+
+func (u QuotaUsage) sub(other QuotaUsage) QuotaUsage {
+	return QuotaUsage{
+		Vcpus:     max(u.Vcpus-other.Vcpus, 0),
+		MemoryMiB: max(u.MemoryMiB-other.MemoryMiB, 0),
+		DiskMiB:   max(u.DiskMiB-other.DiskMiB, 0),
+		Instances: max(u.Instances-other.Instances, 0),
+	}
+}
+
+// check returns an error naming the first resource usage exceeds.
+func (q Quota) check(usage QuotaUsage) error {
+	switch {
+	case q.MaxVcpus > 0 && usage.Vcpus > q.MaxVcpus:
+		return fmt.Errorf("%d vCPUs over quota of %d", usage.Vcpus, q.MaxVcpus)
+	case q.MaxMemoryMiB > 0 && usage.MemoryMiB > q.MaxMemoryMiB:
+		return fmt.Errorf("%d MiB memory over quota of %d MiB", usage.MemoryMiB, q.MaxMemoryMiB)
+	case q.MaxDiskMiB > 0 && usage.DiskMiB > q.MaxDiskMiB:
+		return fmt.Errorf("%d MiB disk over quota of %d MiB", usage.DiskMiB, q.MaxDiskMiB)
+	case q.MaxInstances > 0 && usage.Instances > q.MaxInstances:
+		return fmt.Errorf("%d instances over quota of %d", usage.Instances, q.MaxInstances)
+	}
+	return nil
+}
+
+func (q Quota) remaining(usage QuotaUsage) QuotaUsage {
+	remaining := func(limit int64, used int64) int64 {
+		if limit == 0 {
+			return -1
+		}
+		return max(limit-used, 0)
+	}
+
+	return QuotaUsage{
+		Vcpus:     remaining(q.MaxVcpus, usage.Vcpus),
+		MemoryMiB: remaining(q.MaxMemoryMiB, usage.MemoryMiB),
+		DiskMiB:   remaining(q.MaxDiskMiB, usage.DiskMiB),
+		Instances: remaining(q.MaxInstances, usage.Instances),
+	}
+}
+
+// TenantQuota is a quota shared by every group of a tenant.
+type TenantQuota struct {
+	sync.Mutex
+	Name    string `json:"name"`
+	Quota   Quota  `json:"quota"`
+	members []*VirtController
+}
+
+func NewTenantQuota(name string, quota Quota) *TenantQuota {
+	return &TenantQuota{
+		Name:  name,
+		Quota: quota,
+	}
+}
+
+// LoadTenantQuotas reads a JSON list of {"name": ..., "quota": {...}}.
+func LoadTenantQuotas(path string) ([]*TenantQuota, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tenants []*TenantQuota
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, err
+	}
+
+	for _, tenant := range tenants {
+		if tenant.Name == "" {
+			return nil, fmt.Errorf("tenant quota has no name")
+		}
+	}
+	return tenants, nil
+}
+
+// Join counts the usage of m against the tenant quota.
+func (t *TenantQuota) Join(m *VirtController) {
+	t.Lock()
+	t.members = append(t.members, m)
+	t.Unlock()
+
+	m.quotaMu.Lock()
+	m.tenantQuota = t
+	m.quotaMu.Unlock()
+}
+
+// usage must be called with t locked.
+func (t *TenantQuota) usage() QuotaUsage {
+	usage := QuotaUsage{}
+	for _, member := range t.members {
+		usage = usage.add(member.quotaUsage())
+	}
+	return usage
+}
+
+func (t *TenantQuota) Status() QuotaStatus {
+	t.Lock()
+	defer t.Unlock()
+
+	usage := t.usage()
+	return QuotaStatus{
+		Scope:     QUOTA_SCOPE_TENANT,
+		Name:      t.Name,
+		Quota:     t.Quota,
+		Usage:     usage,
+		Remaining: t.Quota.remaining(usage),
+	}
+}
+
+// quotaUsage counts the instances of the group and its pools. Vertical
+// scaling changes the vCPUs, so they are read from the domains.
+func (m *VirtController) quotaUsage() QuotaUsage {
+	group := m.getGroup()
+	instances := m.GetInstances()
+	instances = append(instances, m.warmPool.list()...)
+	instances = append(instances, m.standby.list()...)
+
+	m.quotaMu.Lock()
+	usage := m.quotaReserved
+	m.quotaMu.Unlock()
+
+	for _, inst := range instances {
+		instanceUsage := usageOf(group.request(group.typeOf(inst)))
+		if size, err := inst.GetSize(); err == nil {
+			instanceUsage.Vcpus = int64(size.Vcpus)
+			instanceUsage.MemoryMiB = int64(size.MaxMemoryMiB)
+		}
+		usage = usage.add(instanceUsage)
+	}
+	return usage
+}
+
+// reserveQuota admits request against the group and tenant quotas before a
+// creation, the reservation is held until the instance is counted.
+func (m *VirtController) reserveQuota(request QuotaUsage) error {
+	m.quotaMu.Lock()
+	tenant := m.tenantQuota
+	m.quotaMu.Unlock()
+
+	// the usage is counted and reserved in one step, for all groups of the
+	// tenant when there is one
+	if tenant != nil {
+		tenant.Lock()
+		defer tenant.Unlock()
+	} else {
+		m.quotaAdmitMu.Lock()
+		defer m.quotaAdmitMu.Unlock()
+	}
+
+	group := m.getGroup()
+	if err := group.Quota.check(m.quotaUsage().add(request)); err != nil {
+		return fmt.Errorf("group %s: %v", group.Name, err)
+	}
+
+	if tenant != nil {
+		if err := tenant.Quota.check(tenant.usage().add(request)); err != nil {
+			return fmt.Errorf("tenant %s: %v", tenant.Name, err)
+		}
+	}
+
+	m.quotaMu.Lock()
+	m.quotaReserved = m.quotaReserved.add(request)
+	m.quotaMu.Unlock()
+	return nil
+}
+
+func (m *VirtController) releaseQuota(request QuotaUsage) {
+	m.quotaMu.Lock()
+	defer m.quotaMu.Unlock()
+	m.quotaReserved = m.quotaReserved.sub(request)
+}
+
+// placeInstance admits an instance of fleetType against the quotas and
+// places it. launchVM releases the host reservation, the caller the quota
+// reservation once the instance is in the map or a pool.
+func (m *VirtController) placeInstance(group GroupConfig, fleetType FleetInstanceType) (*host.Host, error) {
+	req := group.request(fleetType)
+	if err := m.reserveQuota(usageOf(req)); err != nil {
+		log.Printf("[Quota] Refused %s instance: %v\n", fleetType.Type, err)
+		return nil, err
+	}
+
+	h, err := m.scheduler.Place(req)
+	if err != nil {
+		m.releaseQuota(usageOf(req))
+		return nil, err
+	}
+	return h, nil
+}
+
+// GetQuotaStatus returns the group quota and, when the group belongs to a
+// tenant, the tenant quota.
+func (m *VirtController) GetQuotaStatus() []QuotaStatus {
+	group := m.getGroup()
+	usage := m.quotaUsage()
+
+	statuses := []QuotaStatus{{
+		Scope:     QUOTA_SCOPE_GROUP,
+		Name:      group.Name,
+		Quota:     group.Quota,
+		Usage:     usage,
+		Remaining: group.Quota.remaining(usage),
+	}}
+
+	m.quotaMu.Lock()
+	tenant := m.tenantQuota
+	m.quotaMu.Unlock()
+	if tenant != nil {
+		statuses = append(statuses, tenant.Status())
+	}
+	return statuses
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"log"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// domainRefresher is an instance whose domain handle belongs to a libvirt
+// connection.
+type domainRefresher interface {
+	RefreshDomain(conn *libvirt.Connect) error
+}
+
+func (m *VirtController) isHostConnected(inst instance.InstanceManager) bool {
+	h := m.scheduler.Host(inst.GetHost())
+	return h != nil && h.IsConnected()
+}
+
+// refreshDomains swaps the stale domain handles of the instances on h after
+// its connection was re-established. Instances whose domain disappeared
+// while the hypervisor was down are replaced.
+func (m *VirtController) refreshDomains(h *host.Host) {
+	conn := h.Conn()
+	if conn == nil {
+		return
+	}
+
+	m.Lock()
+	instances := []instance.InstanceManager{}
+	for _, inst := range m.MapInstanceIdToInstance {
+		instances = append(instances, inst)
+	}
+	m.Unlock()
+
+	missing := []instance.InstanceManager{}
+	for _, inst := range instances {
+		if inst.GetHost() != h.URI {
+			continue
+		}
+
+		refresher, ok := inst.(domainRefresher)
+		if !ok {
+			continue
+		}
+
+		if err := refresher.RefreshDomain(conn); err != nil {
+			log.Printf("[VirtController] %s is gone after reconnect to %s: %v\n", inst.GetID(), h.URI, err)
+			missing = append(missing, inst)
+		}
+	}
+
+	for _, pool := range []*WarmPool{m.standby, m.warmPool} {
+		for _, inst := range pool.list() {
+			if inst.GetHost() != h.URI {
+				continue
+			}
+
+			if refresher, ok := inst.(domainRefresher); ok {
+				if err := refresher.RefreshDomain(conn); err != nil {
+					log.Printf("[%s] %s is gone after reconnect to %s: %v\n", pool.name, inst.GetID(), h.URI, err)
+					pool.remove(inst)
+				}
+			}
+		}
+	}
+
+	maxReplacements := helper.GetEnvInt("HEALTH_REPLACEMENT_MAX", 3)
+	window := time.Duration(helper.GetEnvInt("HEALTH_REPLACEMENT_WINDOW_MIN", 10)) * time.Minute
+	for _, inst := range missing {
+		if !m.replacement.begin(inst.GetID(), maxReplacements, window) {
+			log.Printf("[VirtController] Replacement limit %d per %v reached, keep %s\n", maxReplacements, window, inst.GetID())
+			continue
+		}
+		go m.replaceMissingInstance(inst)
+	}
+
+	log.Printf("[VirtController] Resumed group %s on %s\n", m.getGroup().Name, h.URI)
+}
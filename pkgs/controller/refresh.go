@@ -0,0 +1,422 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/lb"
+)
+
+// RefreshConfig controls how an instance refresh replaces the fleet.
+type RefreshConfig struct {
+	// MinHealthyPercentage of the fleet that has to stay in service, the
+	// rest may be terminated before its replacement is healthy
+	MinHealthyPercentage int
+	// MaxSurge is how many instances may run above the fleet size
+	MaxSurge int
+	// BatchPause is the wait between two batches
+	BatchPause time.Duration
+	// HealthyTimeout is how long a new batch has to become healthy
+	HealthyTimeout time.Duration
+	// AutoRollback restores the previous template when a batch fails
+	AutoRollback bool
+}
+
+func RefreshConfigFromEnv() RefreshConfig {
+	return RefreshConfig{
+		MinHealthyPercentage: helper.GetEnvInt("REFRESH_MIN_HEALTHY_PERCENTAGE", 90),
+		MaxSurge:             helper.GetEnvInt("REFRESH_MAX_SURGE", 1),
+		BatchPause:           time.Duration(helper.GetEnvInt("REFRESH_BATCH_PAUSE_SEC", 60)) * time.Second,
+		HealthyTimeout:       time.Duration(helper.GetEnvInt("REFRESH_HEALTHY_TIMEOUT_MIN", 15)) * time.Minute,
+		AutoRollback:         helper.GetEnvBool("REFRESH_AUTO_ROLLBACK", true),
+	}
+}
+
+type RefreshState string
+
+const (
+	REFRESH_STATE_NONE        RefreshState = ""
+	REFRESH_STATE_IN_PROGRESS RefreshState = "in-progress"
+	REFRESH_STATE_SUCCESSFUL  RefreshState = "successful"
+	REFRESH_STATE_FAILED      RefreshState = "failed"
+	REFRESH_STATE_ROLLED_BACK RefreshState = "rolled-back"
+)
+
+type RefreshStatus struct {
+	State           RefreshState `json:"state"`
+	TemplateVersion string       `json:"templateVersion"`
+	Replaced        int          `json:"replaced"`
+	Total           int          `json:"total"`
+	Error           string       `json:"error,omitempty"`
+}
+
+type instanceRefresh struct {
+	sync.Mutex
+	status RefreshStatus
+}
+
+func (r *instanceRefresh) get() RefreshStatus {
+	r.Lock()
+	defer r.Unlock()
+	return r.status
+}
+
+func (r *instanceRefresh) update(f func(status *RefreshStatus)) {
+	r.Lock()
+	defer r.Unlock()
+	f(&r.status)
+}
+
+// UpdateGroup changes the template of the group. Running instances keep the
+// old template until an instance refresh replaces them, the warm pool and
+// golden image are rebuilt right away.
+func (m *VirtController) UpdateGroup(group GroupConfig) error {
+	if err := group.Validate(); err != nil {
+		return err
+	}
+
+	if m.refresh.get().State == REFRESH_STATE_IN_PROGRESS {
+		return fmt.Errorf("group %s has an instance refresh in progress", group.Name)
+	}
+
+	m.groupMu.Lock()
+	if group.Name != m.group.Name {
+		m.groupMu.Unlock()
+		return fmt.Errorf("group %s cannot be renamed to %s", m.group.Name, group.Name)
+	}
+	previousGroup := m.group
+	m.previousGroup = &previousGroup
+	m.group = group
+	m.groupMu.Unlock()
+
+	if previousGroup.TemplateVersion() == group.TemplateVersion() {
+		return nil
+	}
+
+	log.Printf("[VirtController] Group %s template changed %s -> %s\n", group.Name, previousGroup.TemplateVersion(), group.TemplateVersion())
+	m.rebuildLaunchCaches()
+	return nil
+}
+
+// rebuildLaunchCaches drops warm and standby instances and the golden image
+// of the old template, they are recreated from the current one.
+func (m *VirtController) rebuildLaunchCaches() {
+	for _, pool := range []*WarmPool{m.standby, m.warmPool} {
+		for _, inst := range pool.take(pool.Size()) {
+			if err := inst.Shutdown(); err != nil {
+				log.Printf("[%s] Failed to remove %s: %v\n", pool.name, inst.GetID(), err)
+			}
+		}
+	}
+
+	m.goldenImage.reset()
+	if FastBootMode(helper.GetEnv("FAST_BOOT_MODE", string(FAST_BOOT_MODE_COLD))) == FAST_BOOT_MODE_SNAPSHOT {
+		go func() {
+			if err := m.prepareGoldenImage(); err != nil {
+				log.Printf("[VirtController] Failed to prepare golden image, keep cold boot: %v\n", err)
+			}
+		}()
+	}
+}
+
+func (m *VirtController) GetInstanceRefreshStatus() RefreshStatus {
+	return m.refresh.get()
+}
+
+// StartInstanceRefresh replaces every instance whose template version is not
+// the current one, in batches and in the background.
+func (m *VirtController) StartInstanceRefresh(config RefreshConfig) error {
+	if config.MinHealthyPercentage < 0 || config.MinHealthyPercentage > 100 {
+		return fmt.Errorf("min healthy percentage %d is out of range", config.MinHealthyPercentage)
+	}
+
+	if config.MaxSurge < 0 {
+		return fmt.Errorf("max surge %d is negative", config.MaxSurge)
+	}
+
+	templateVersion := m.getGroup().TemplateVersion()
+
+	m.refresh.Lock()
+	if m.refresh.status.State == REFRESH_STATE_IN_PROGRESS {
+		m.refresh.Unlock()
+		return fmt.Errorf("instance refresh to %s is in progress", m.refresh.status.TemplateVersion)
+	}
+	m.refresh.status = RefreshStatus{
+		State:           REFRESH_STATE_IN_PROGRESS,
+		TemplateVersion: templateVersion,
+	}
+	m.refresh.Unlock()
+
+	go func() {
+		err := m.runInstanceRefresh(config)
+		if err == nil {
+			m.refresh.update(func(status *RefreshStatus) {
+				status.State = REFRESH_STATE_SUCCESSFUL
+			})
+			log.Printf("[VirtController] Instance refresh to %s successful\n", templateVersion)
+			return
+		}
+
+		log.Printf("[VirtController] Instance refresh to %s failed: %v\n", templateVersion, err)
+		m.refresh.update(func(status *RefreshStatus) {
+			status.State = REFRESH_STATE_FAILED
+			status.Error = err.Error()
+		})
+
+		if config.AutoRollback && m.rollbackGroup() {
+			rollbackConfig := config
+			rollbackConfig.AutoRollback = false
+			if err := m.runInstanceRefresh(rollbackConfig); err != nil {
+				log.Printf("[VirtController] Rollback of %s failed: %v\n", templateVersion, err)
+				return
+			}
+
+			m.refresh.update(func(status *RefreshStatus) {
+				status.State = REFRESH_STATE_ROLLED_BACK
+			})
+			log.Printf("[VirtController] Rolled back %s\n", templateVersion)
+		}
+	}()
+
+	return nil
+}
+
+// rollbackGroup restores the template in use before the last UpdateGroup.
+func (m *VirtController) rollbackGroup() bool {
+	m.groupMu.Lock()
+	if m.previousGroup == nil {
+		m.groupMu.Unlock()
+		return false
+	}
+	m.group = *m.previousGroup
+	m.previousGroup = nil
+	m.groupMu.Unlock()
+
+	m.rebuildLaunchCaches()
+	return true
+}
+
+// outdatedInstances returns the instances not built from templateVersion,
+// oldest first. Protected instances keep their template until the
+// protection is removed.
+func (m *VirtController) outdatedInstances(templateVersion string) []instance.InstanceManager {
+	running, _, _ := m.GetRunningInstance()
+	candidates := m.SelectScaleInCandidates(running)
+
+	outdated := []instance.InstanceManager{}
+	for _, inst := range candidates {
+		if inst.GetTemplateVersion() == templateVersion {
+			continue
+		}
+
+		if inst.IsScaleInProtected() {
+			log.Printf("[VirtController] %s is protected, skip it in the refresh\n", inst.GetID())
+			continue
+		}
+
+		outdated = append(outdated, inst)
+	}
+	return outdated
+}
+
+// runInstanceRefresh replaces outdated instances batch by batch. Up to
+// fleet size minus the min healthy instances are terminated before their
+// replacements launch, MaxSurge more are replaced once the new batch is
+// healthy in the load balancer.
+func (m *VirtController) runInstanceRefresh(config RefreshConfig) error {
+	group := m.getGroup()
+	templateVersion := group.TemplateVersion()
+
+	running, _, _ := m.GetRunningInstance()
+	minHealthy := (running*config.MinHealthyPercentage + 99) / 100
+	inPlace := max(running-minHealthy, 0)
+	surge := config.MaxSurge
+	if inPlace == 0 && surge == 0 {
+		// a refresh that can neither go below nor above the fleet size
+		// could never progress
+		surge = 1
+	}
+
+	outdated := m.outdatedInstances(templateVersion)
+	m.refresh.update(func(status *RefreshStatus) {
+		status.TemplateVersion = templateVersion
+		status.Replaced = 0
+		status.Total = len(outdated)
+	})
+	log.Printf("[VirtController] Refreshing %d instances of group %s to %s, batch %d in place + %d surge\n", len(outdated), group.Name, templateVersion, inPlace, surge)
+
+	for len(outdated) > 0 {
+		batchSize := min(inPlace+surge, len(outdated))
+		batch := outdated[:batchSize]
+		outdated = outdated[batchSize:]
+
+		numInPlace := min(inPlace, batchSize)
+		for _, inst := range batch[:numInPlace] {
+			if err := m.terminate(inst, false); err != nil {
+				log.Printf("[VirtController] Failed to terminate outdated %s: %v\n", inst.GetID(), err)
+			}
+		}
+
+		newInstances, err := m.launchBatch(group, capacityOf(batch))
+		if err == nil {
+			err = m.waitForHealthy(newInstances, config.HealthyTimeout)
+		}
+
+		if err != nil {
+			for _, inst := range newInstances {
+				if err := m.terminate(inst, false); err != nil {
+					log.Printf("[VirtController] Failed to terminate %s of failed batch: %v\n", inst.GetID(), err)
+				}
+			}
+
+			// the rollback only replaces outdated instances, so the in-place
+			// ones are brought back here or the group would stay below its
+			// min healthy
+			if numInPlace > 0 {
+				m.relaunchCapacity(m.outdatedGroup(), capacityOf(batch[:numInPlace]))
+			}
+			return err
+		}
+
+		for _, inst := range batch[numInPlace:] {
+			if err := m.terminate(inst, false); err != nil {
+				log.Printf("[VirtController] Failed to terminate outdated %s: %v\n", inst.GetID(), err)
+			}
+		}
+
+		m.refresh.update(func(status *RefreshStatus) {
+			status.Replaced += batchSize
+		})
+		log.Printf("[VirtController] Refreshed %d instances, %d left\n", batchSize, len(outdated))
+
+		if len(outdated) > 0 {
+			time.Sleep(config.BatchPause)
+		}
+	}
+
+	return nil
+}
+
+// outdatedGroup is the group as the instances a refresh replaces were built,
+// the template before the last UpdateGroup when it is still known.
+func (m *VirtController) outdatedGroup() GroupConfig {
+	m.groupMu.RLock()
+	defer m.groupMu.RUnlock()
+	if m.previousGroup != nil {
+		return *m.previousGroup
+	}
+	return m.group
+}
+
+// relaunchCapacity launches units of capacity from the template of group
+// after a failed replacement terminated instances without a successor.
+// Whatever starts is kept, it is capacity the group had before.
+func (m *VirtController) relaunchCapacity(group GroupConfig, units int) {
+	log.Printf("[VirtController] Relaunching %d lost units of group %s from %s\n", units, group.Name, group.TemplateVersion())
+	newInstances, err := m.launchBatch(group, units)
+	if err != nil {
+		log.Printf("[VirtController] Relaunched %d of %d lost units: %v\n", capacityOf(newInstances), units, err)
+		return
+	}
+	log.Printf("[VirtController] Relaunched %d lost units\n", units)
+}
+
+// launchBatch starts instances of the template of group that add up to
+// units of weighted capacity.
+func (m *VirtController) launchBatch(group GroupConfig, units int) ([]instance.InstanceManager, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	newInstances := []instance.InstanceManager{}
+	var launchErr error
+
+	for remaining := units; remaining > 0; {
+		h, fleetType, err := m.place(group, remaining)
+		if err != nil {
+			launchErr = err
+			break
+		}
+		remaining -= fleetType.Weight
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inst, err := m.startInstance(h, group, fleetType)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				launchErr = err
+				return
+			}
+			newInstances = append(newInstances, inst)
+		}()
+	}
+
+	wg.Wait()
+	return newInstances, launchErr
+}
+
+// waitForHealthy waits until every instance is alive in the load balancer,
+// or running when the group has no load balancer.
+func (m *VirtController) waitForHealthy(instances []instance.InstanceManager, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		healthy := 0
+		aliveBackends := make(map[string]bool)
+		if m.hasLoadBalancer() {
+			backendURLs, err := m.getAliveBackends()
+			if err != nil {
+				log.Printf("[VirtController] Failed to get alive backends: %v\n", err)
+			}
+			for _, backendURL := range backendURLs {
+				aliveBackends[backendURL] = true
+			}
+		}
+
+		for _, inst := range instances {
+			if inst.GetStatus() != instance.VM_STATE_RUNNING {
+				continue
+			}
+
+			if !m.hasLoadBalancer() || aliveBackends[inst.GetBackendURL()] {
+				healthy++
+			}
+		}
+
+		if healthy == len(instances) {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d of %d new instances healthy after %v", healthy, len(instances), timeout)
+		}
+
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func (m *VirtController) getAliveBackends() ([]string, error) {
+	resp, err := http.Get(m.getGroup().LoadBalancerURL + "/backend?status=alive")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var backends []lb.BackendResponse
+	if err := json.NewDecoder(resp.Body).Decode(&backends); err != nil {
+		return nil, err
+	}
+
+	backendURLs := []string{}
+	for _, backend := range backends {
+		backendURLs = append(backendURLs, backend.URL)
+	}
+	return backendURLs, nil
+}
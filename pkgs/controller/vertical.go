@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+)
+
+// VerticalHeadroom reports how many vertical steps the running instances
+// can still take up and down, a step being the instance type size of vCPUs
+// and memory added to or removed from every instance.
+func (m *VirtController) VerticalHeadroom() (int, int) {
+	group := m.getGroup()
+	if group.MaxVcpus == 0 && group.MaxMemoryMiB == 0 {
+		return 0, 0
+	}
+
+	_, instances, err := m.GetRunningInstance()
+	if err != nil || len(instances) == 0 {
+		return 0, 0
+	}
+
+	up, down := -1, -1
+	for _, inst := range instances {
+		size, err := inst.GetSize()
+		if err != nil {
+			log.Println(err)
+			return 0, 0
+		}
+
+		instUp, instDown := stepsBetween(size, group, group.typeOf(inst))
+		if up < 0 || instUp < up {
+			up = instUp
+		}
+		if down < 0 || instDown < down {
+			down = instDown
+		}
+	}
+	return up, down
+}
+
+// stepsBetween counts the steps from size to the group maximum and back to
+// the size of fleetType.
+func stepsBetween(size instance.InstanceSize, group GroupConfig, fleetType FleetInstanceType) (int, int) {
+	up, down := -1, -1
+	if group.maxVcpus(fleetType) > fleetType.Vcpus {
+		up = int((min(size.MaxVcpus, group.maxVcpus(fleetType)) - min(size.Vcpus, size.MaxVcpus)) / fleetType.Vcpus)
+		down = int((max(size.Vcpus, fleetType.Vcpus) - fleetType.Vcpus) / fleetType.Vcpus)
+	}
+
+	if group.maxMemoryMiB(fleetType) > fleetType.MemoryMiB {
+		memUp := int((min(size.MaxMemoryMiB, group.maxMemoryMiB(fleetType)) - min(size.MemoryMiB, size.MaxMemoryMiB)) / fleetType.MemoryMiB)
+		memDown := int((max(size.MemoryMiB, fleetType.MemoryMiB) - fleetType.MemoryMiB) / fleetType.MemoryMiB)
+		if up < 0 || memUp < up {
+			up = memUp
+		}
+		if down < 0 || memDown < down {
+			down = memDown
+		}
+	}
+	return max(up, 0), max(down, 0)
+}
+
+// ScaleVertical resizes every running instance by steps, positive steps
+// hot-plug one instance type size of vCPUs and memory each, negative steps
+// remove them. It shares the cooldowns of ScaleUp and ScaleDown and returns the
+// number of instances that were resized.
+func (m *VirtController) ScaleVertical(steps int) int {
+	if steps == 0 {
+		return 0
+	}
+
+	now := time.Now()
+
+	m.Lock()
+	if steps > 0 && now.Sub(m.LastScaleUp) < m.ScaleUpCoolDown {
+		log.Println("[VirtController] ScaleVertical is cooldown, last action", m.LastScaleUp)
+		m.Unlock()
+		return 0
+	}
+	if steps < 0 && now.Sub(m.LastScaleDown) < m.ScaleDownCoolDown {
+		log.Println("[VirtController] ScaleVertical is cooldown, last action", m.LastScaleDown)
+		m.Unlock()
+		return 0
+	}
+	m.Unlock()
+
+	up, down := m.VerticalHeadroom()
+	if steps > up {
+		steps = up
+	}
+	if -steps > down {
+		steps = -down
+	}
+	if steps == 0 {
+		log.Println("[VirtController] No vertical headroom left")
+		return 0
+	}
+
+	_, instances, err := m.GetRunningInstance()
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+
+	log.Printf("[VirtController] Start ScaleVertical %d steps on %d instances\n", steps, len(instances))
+	m.Lock()
+	if steps > 0 {
+		m.LastScaleUp = now
+	}
+	m.LastScaleDown = now
+	m.Unlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	resized := 0
+	for _, inst := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.resizeInstance(inst, steps); err != nil {
+				log.Printf("[VirtController] Failed to resize %s: %v\n", inst.GetID(), err)
+				return
+			}
+			mu.Lock()
+			resized++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return resized
+}
+
+// resizeInstance moves inst by steps. The memory up to the maximum is
+// already allocated on the host, only added vCPUs go through admission.
+func (m *VirtController) resizeInstance(inst instance.InstanceManager, steps int) error {
+	group := m.getGroup()
+	fleetType := group.typeOf(inst)
+	size, err := inst.GetSize()
+	if err != nil {
+		return err
+	}
+
+	vcpus := uint(max(int(size.Vcpus)+steps*int(fleetType.Vcpus), int(fleetType.Vcpus)))
+	vcpus = min(vcpus, group.maxVcpus(fleetType), size.MaxVcpus)
+	memoryMiB := uint64(max(int64(size.MemoryMiB)+int64(steps)*int64(fleetType.MemoryMiB), int64(fleetType.MemoryMiB)))
+	memoryMiB = min(memoryMiB, group.maxMemoryMiB(fleetType), size.MaxMemoryMiB)
+
+	if vcpus > size.Vcpus {
+		h := m.scheduler.Host(inst.GetHost())
+		if h == nil {
+			return fmt.Errorf("unknown host %s", inst.GetHost())
+		}
+
+		quotaReq := QuotaUsage{Vcpus: int64(vcpus - size.Vcpus)}
+		if err := m.reserveQuota(quotaReq); err != nil {
+			return err
+		}
+		defer m.releaseQuota(quotaReq)
+
+		req := host.Request{Vcpus: vcpus - size.Vcpus}
+		if err := m.scheduler.Reserve(h, req); err != nil {
+			return err
+		}
+		defer m.scheduler.Done(h, req)
+	}
+
+	return inst.Resize(vcpus, memoryMiB)
+}
@@ -2,35 +2,57 @@ package controller
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"maps"
 	"os"
-	"strconv"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	genconfig "github.com/linlynnn/kvm-autoscaler/pkgs/gen-config"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
 	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
-	"github.com/linlynnn/kvm-autoscaler/pkgs/lb"
-	"libvirt.org/go/libvirt"
+	libvirt "libvirt.org/go/libvirt"
 )
 
 type VirtController struct {
 	sync.Mutex
-	conn                    *libvirt.Connect
+	scheduler               *host.Scheduler
+	groupMu                 sync.RWMutex
+	group                   GroupConfig
+	previousGroup           *GroupConfig
+	refresh                 *instanceRefresh
 	MapInstanceIdToInstance map[string]instance.InstanceManager
 	LastScaleUp             time.Time
 	LastScaleDown           time.Time
 	ScaleUpCoolDown         time.Duration
 	ScaleDownCoolDown       time.Duration
-	loadBalancer            *lb.LoadBalancer
+	warmPool                *WarmPool
+	standby                 *WarmPool
+	goldenImage             *GoldenImage
+	replacement             *replacementLimiter
+	launchQueue             *LaunchQueue
+	// terminating holds the instances the controller is shutting down, their
+	// lifecycle events are expected
+	terminating map[string]bool
+	hooks       *lifecycleHooks
+	// quotaReserved holds the launches in flight, tenantQuota is shared with
+	// the other groups of the tenant
+	quotaMu       sync.Mutex
+	quotaAdmitMu  sync.Mutex
+	quotaReserved QuotaUsage
+	tenantQuota   *TenantQuota
 }
 
 func NewVirtController(
-	conn *libvirt.Connect,
+	scheduler *host.Scheduler,
+	launchQueue *LaunchQueue,
+	group GroupConfig,
 	scaleUpCoolDown time.Duration,
 	scaleDownCoolDown time.Duration,
-	loadBalancer *lb.LoadBalancer,
 ) *VirtController {
 
 	now := time.Now()
@@ -38,17 +60,32 @@ func NewVirtController(
 	lastScaleDown := now.Add(-scaleDownCoolDown - (1 * time.Second))
 
 	return &VirtController{
-		conn:                    conn,
+		scheduler:               scheduler,
+		group:                   group,
 		MapInstanceIdToInstance: make(map[string]instance.InstanceManager),
 		LastScaleUp:             lastScaleUp,
 		LastScaleDown:           lastScaleDown,
 		ScaleUpCoolDown:         scaleUpCoolDown,
 		ScaleDownCoolDown:       scaleDownCoolDown,
-		loadBalancer:            loadBalancer,
+		warmPool:                NewWarmPool("WarmPool"),
+		standby:                 NewWarmPool("Standby"),
+		goldenImage:             &GoldenImage{},
+		replacement:             newReplacementLimiter(),
+		refresh:                 &instanceRefresh{},
+		launchQueue:             launchQueue,
+		terminating:             make(map[string]bool),
+		hooks:                   newLifecycleHooks(),
 	}
 
 }
 
+func (m *VirtController) getGroup() GroupConfig {
+	m.groupMu.RLock()
+	defer m.groupMu.RUnlock()
+	return m.group
+}
+
+// ScaleUp adds numToAdd units of weighted capacity to the group.
 func (m *VirtController) ScaleUp(numToAdd int) {
 
 	now := time.Now()
@@ -61,16 +98,57 @@ func (m *VirtController) ScaleUp(numToAdd int) {
 	}
 	m.Unlock()
 
+	if !m.scheduler.Connected() {
+		log.Println("[VirtController] No hypervisor is reachable, pause ScaleUp")
+		return
+	}
+
+	group := m.getGroup()
+	capacity := m.GetRunningCapacity()
+	if group.MaxSize > 0 && capacity+numToAdd > group.MaxSize {
+		log.Printf("[VirtController] Group %s is bounded to %d units, limit ScaleUp to %d\n", group.Name, group.MaxSize, max(group.MaxSize-capacity, 0))
+		numToAdd = max(group.MaxSize-capacity, 0)
+	}
+
+	if numToAdd <= 0 {
+		return
+	}
+
 	log.Printf("[VirtController] Start ScaleUp %d\n", numToAdd)
 	m.Lock()
 	m.LastScaleUp = now
 	m.LastScaleDown = now
 	m.Unlock()
 
+	// standby instances were serving the group a moment ago, they are resumed
+	// before warm ones
 	var wg sync.WaitGroup
-	for i := 0; i < numToAdd; i++ {
+	remaining := numToAdd
+	for _, pool := range []*WarmPool{m.standby, m.warmPool} {
+		for remaining > 0 {
+			warmInstances := pool.take(1)
+			if len(warmInstances) == 0 {
+				break
+			}
+
+			remaining -= warmInstances[0].GetWeight()
+			wg.Add(1)
+			go m.activateWarmInstance(pool, warmInstances[0], &wg)
+		}
+	}
+
+	// admit every new instance up front so that a scale-up the hosts cannot
+	// take is partially fulfilled instead of overloading them
+	for remaining > 0 {
+		h, fleetType, err := m.place(group, remaining)
+		if err != nil {
+			log.Printf("[VirtController] ScaleUp partially fulfilled %d of %d units: %v\n", numToAdd-remaining, numToAdd, err)
+			break
+		}
+
+		remaining -= fleetType.Weight
 		wg.Add(1)
-		go m.createVM(&wg)
+		go m.createVM(h, fleetType, &wg)
 	}
 
 	wg.Wait()
@@ -88,6 +166,39 @@ func (m *VirtController) ScaleDown(instancesToRemove []instance.InstanceManager)
 	}
 	m.Unlock()
 
+	// instances on an unreachable hypervisor cannot be shut down until it is
+	// back, protected instances are kept on purpose
+	removable := []instance.InstanceManager{}
+	for _, inst := range instancesToRemove {
+		if !m.isHostConnected(inst) {
+			log.Printf("[VirtController] Hypervisor of %s is unreachable, keep it\n", inst.GetID())
+		} else if inst.IsScaleInProtected() {
+			log.Printf("[VirtController] %s is protected from scale-in, keep it\n", inst.GetID())
+		} else {
+			removable = append(removable, inst)
+		}
+	}
+	instancesToRemove = removable
+
+	group := m.getGroup()
+	capacity := m.GetRunningCapacity()
+	if capacity-capacityOf(instancesToRemove) < group.MinSize {
+		// keep the instances whose removal would go below the min size
+		kept := []instance.InstanceManager{}
+		for _, inst := range instancesToRemove {
+			if capacity-inst.GetWeight() >= group.MinSize {
+				capacity -= inst.GetWeight()
+				kept = append(kept, inst)
+			}
+		}
+		log.Printf("[VirtController] Group %s keeps at least %d units, limit ScaleDown to %d instances\n", group.Name, group.MinSize, len(kept))
+		instancesToRemove = kept
+	}
+
+	if len(instancesToRemove) == 0 {
+		return
+	}
+
 	log.Printf("[VirtController] Start ScaleDown %d\n", len(instancesToRemove))
 	m.Lock()
 	m.LastScaleDown = now
@@ -103,35 +214,123 @@ func (m *VirtController) ScaleDown(instancesToRemove []instance.InstanceManager)
 
 }
 
-func (m *VirtController) createVM(wg *sync.WaitGroup) error {
+func (m *VirtController) createVM(h *host.Host, fleetType FleetInstanceType, wg *sync.WaitGroup) error {
 
 	defer wg.Done()
+	_, err := m.startInstance(h, m.getGroup(), fleetType)
+	return err
+
+}
+
+// startInstance launches an instance of fleetType from the template of group
+// on the reserved host h, adds it to the group and registers it with the
+// load balancer.
+func (m *VirtController) startInstance(h *host.Host, group GroupConfig, fleetType FleetInstanceType) (instance.InstanceManager, error) {
+
+	instanceMng, err := m.launchVM(h, group, fleetType)
+	if err != nil {
+		m.releaseQuota(usageOf(group.request(fleetType)))
+		return nil, err
+	}
+
+	// the quota reservation is held until the instance is counted in the map
+	m.Lock()
+	m.MapInstanceIdToInstance[instanceMng.GetID()] = instanceMng
+	m.Unlock()
+	m.releaseQuota(usageOf(group.request(fleetType)))
+
+	if m.runLifecycleHook(instanceMng, LIFECYCLE_TRANSITION_LAUNCHING) == LIFECYCLE_RESULT_ABANDON {
+		m.terminate(instanceMng, false)
+		err := fmt.Errorf("launch of %s abandoned by lifecycle hook", instanceMng.GetID())
+		log.Println(err)
+		return nil, err
+	}
+
+	m.registerInstance(instanceMng)
+
+	log.Printf("[VirtController] Created VM %s\n", instanceMng.GetID())
+	return instanceMng, nil
+
+}
+
+// launchVM restores the instance from the golden memory state when it is
+// ready and falls back to a cold boot otherwise. h must have been reserved
+// with the scheduler, the reservation is released once the domain is up.
+// The quota reservation is left to the caller until it counts the instance.
+// Launches go through the launch queue to bound the concurrent creations.
+// The golden image only holds the primary instance type.
+func (m *VirtController) launchVM(h *host.Host, group GroupConfig, fleetType FleetInstanceType) (*instance.VirtInstanceManager, error) {
+
+	defer m.scheduler.Done(h, group.request(fleetType))
+
+	launchID := m.launchQueue.acquire(group.Name, h.URI)
+	defer m.launchQueue.release(launchID)
+
+	if !h.IsConnected() {
+		err := fmt.Errorf("hypervisor %s is unreachable", h.URI)
+		log.Println(err)
+		return nil, err
+	}
+
+	if fleetType.Type == group.primaryType().Type && m.goldenImage.isReadyOn(h, group.TemplateVersion()) {
+		instanceMng, err := m.restoreVM(h, group, fleetType)
+		if err == nil {
+			return instanceMng, nil
+		}
+		log.Println("[VirtController] Restore failed, fallback to cold boot")
+	}
+
+	return m.bootVM(h, group, fleetType)
+
+}
+
+// bootVM generates the instance configs, defines the domain of fleetType
+// from the template of group on h and boots it.
+func (m *VirtController) bootVM(h *host.Host, group GroupConfig, fleetType FleetInstanceType) (*instance.VirtInstanceManager, error) {
+
 	uuid := uuid.New()
 	log.Printf("[VirtController] Creating VM instance-%v\n", uuid.String())
-	if err := genconfig.GenQcow2DiskImage(uuid.String()); err != nil {
+	// the connection is taken once, it is nil while the host reconnects
+	conn := h.Conn()
+	if conn == nil {
+		err := fmt.Errorf("hypervisor %s is unreachable", h.URI)
 		log.Println(err)
-		return err
+		return nil, err
 	}
 
-	if err := genconfig.GenMetaDataInstanceConfig(uuid.String()); err != nil {
+	overlay, err := genconfig.GenOverlayVolume(conn, group.StoragePool, uuid.String(), group.BaseImageName, group.DiskMiB)
+	if err != nil {
 		log.Println(err)
-		return err
+		return nil, err
 	}
 
-	if err := genconfig.GenUserDataInstanceConfig(uuid.String(), os.Getenv("SSH_PUBLIC_KEY")); err != nil {
-		log.Println(err)
-		return err
+	// the volumes outlive a failed launch unless the domain was defined,
+	// Shutdown deletes them from then on
+	volumes := []genconfig.OverlayVolume{overlay}
+	defined := false
+	defer func() {
+		if !defined {
+			m.deleteVolumes(h, volumes)
+		}
+	}()
+
+	seed, err := m.genCloudInitConfig(conn, uuid.String(), group)
+	if err != nil {
+		return nil, err
 	}
+	volumes = append(volumes, seed)
 
-	if err := genconfig.GenCdRomDiskImage(uuid.String()); err != nil {
+	metadata, err := instanceMetadata(group, fleetType).DomainXML()
+	if err != nil {
 		log.Println(err)
-		return err
+		return nil, err
 	}
 
-	virtInstanceConfigPath, err := genconfig.GenVirtInstanceConfig(uuid.String())
+	domainSpec := genconfig.NewInstanceDomain(uuid.String(), overlay, seed, fleetType.MemoryMiB, group.maxMemoryMiB(fleetType), fleetType.Vcpus, group.maxVcpus(fleetType), metadata)
+	virtInstanceConfigPath, err := genconfig.GenVirtInstanceConfig(domainSpec, group.DomainXMLTemplate)
 	if err != nil {
 		log.Println(err)
-		return err
+		return nil, err
 	}
 
 	// read xml file and then register
@@ -142,28 +341,83 @@ func (m *VirtController) createVM(wg *sync.WaitGroup) error {
 
 	domainXML := string(xmlBytes)
 
-	domain, err := m.conn.DomainDefineXML(domainXML)
+	// libvirt also checks the XML against its schema
+	domain, err := conn.DomainDefineXMLFlags(domainXML, libvirt.DOMAIN_DEFINE_VALIDATE)
 	if err != nil {
 		log.Printf("[VirtController] Failed to define domain: %v\n", err)
-		return err
+		return nil, err
 	}
+	defined = true
 
 	instanceId := "instance-" + uuid.String()
-	instanceMng := instance.NewVirtInstanceManager(domain, instanceId)
-
-	m.Lock()
-	m.MapInstanceIdToInstance[instanceId] = instanceMng
-	m.Unlock()
+	instanceMng := instance.NewVirtInstanceManager(domain, instanceId, h.URI, group.TargetPort, group.TemplateVersion(), fleetType.Type, fleetType.Weight)
+	instanceMng.WatchState(h)
 
+	// a domain that does not start is undefined along with its volumes
 	if err := domain.Create(); err != nil {
 		log.Println(err)
+		instanceMng.Shutdown()
+		return nil, err
+	}
+
+	return instanceMng, nil
+
+}
+
+// genCloudInitConfig generates the meta-data and user-data and returns the
+// cloud-init seed volume created from them in the pool of group on conn.
+func (m *VirtController) genCloudInitConfig(conn *libvirt.Connect, id string, group GroupConfig) (genconfig.OverlayVolume, error) {
+
+	if err := genconfig.GenMetaDataInstanceConfig(id); err != nil {
+		log.Println(err)
+		return genconfig.OverlayVolume{}, err
+	}
+
+	if err := genconfig.GenUserDataInstanceConfig(id, group.SSHPublicKey, group.UserDataTemplate); err != nil {
+		log.Println(err)
+		return genconfig.OverlayVolume{}, err
+	}
+
+	seed, err := genconfig.GenSeedVolume(conn, group.StoragePool, id)
+	if err != nil {
+		log.Println(err)
+		return genconfig.OverlayVolume{}, err
 	}
 
-	if m.loadBalancer != nil {
+	return seed, nil
+
+}
+
+// deleteVolumes removes the volumes of an instance that was never defined.
+func (m *VirtController) deleteVolumes(h *host.Host, volumes []genconfig.OverlayVolume) {
+	conn := h.Conn()
+	for _, volume := range volumes {
+		if conn == nil {
+			log.Printf("[VirtController] %s is unreachable, volume %s is left in pool %s\n", h.URI, volume.Name, volume.Pool)
+			continue
+		}
+
+		if err := genconfig.DeleteVolume(conn, volume.Pool, volume.Name); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// hasLoadBalancer reports whether the group is served by a load balancer,
+// in-process or not, which instances are registered with and drained from.
+func (m *VirtController) hasLoadBalancer() bool {
+	return m.getGroup().LoadBalancerURL != ""
+}
+
+// registerInstance registers the instance with the load balancer and the
+// prometheus discovery in the background.
+func (m *VirtController) registerInstance(instanceMng instance.InstanceManager) {
+
+	if m.hasLoadBalancer() {
 		go func() {
 			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 			defer cancel()
-			instanceMng.RegisterIP(os.Getenv("LOAD_BALANCER_URL"), ctx)
+			instanceMng.RegisterIP(m.getGroup().LoadBalancerURL, ctx)
 		}()
 	}
 
@@ -171,52 +425,64 @@ func (m *VirtController) createVM(wg *sync.WaitGroup) error {
 		instanceMng.RegisterPromDiscovery()
 	}()
 
-	log.Printf("[VirtController] Created VM instance-%v\n", uuid.String())
-	return nil
-
 }
 
 func (m *VirtController) gracefullyShutdown(inst instance.InstanceManager, wg *sync.WaitGroup) error {
 	defer wg.Done()
-	// need to ensure that instance must shut off
-	// deregisterIP
-	if m.loadBalancer != nil {
+	return m.terminate(inst, true)
+}
 
-		go func() {
-			loadBalancerUrlEnv := os.Getenv("LOAD_BALANCER_URL")
-			if loadBalancerUrlEnv == "" {
-				log.Println("[VirtController] LOAD_BALANCER_URL is not defined, use fallback value: http://localhost:8080")
-				loadBalancerUrlEnv = "http://localhost:8080"
-			}
+// terminate drains and removes the instance, returning it to the warm pool
+// instead when reuse is allowed and configured.
+func (m *VirtController) terminate(inst instance.InstanceManager, allowReuse bool) error {
+	m.Lock()
+	m.terminating[inst.GetID()] = true
+	m.Unlock()
+	defer func() {
+		m.Lock()
+		delete(m.terminating, inst.GetID())
+		m.Unlock()
+	}()
 
-			inst.DeRegisterIP(loadBalancerUrlEnv)
+	// need to ensure that instance must shut off
+	// deregisterIP and wait for its in-flight requests before termination
+	if m.hasLoadBalancer() {
+		inst.DeRegisterIP(m.getGroup().LoadBalancerURL)
+		m.waitForDrain(inst)
+	}
 
-			drainingTimeEnv := os.Getenv("DRAINING_TIME_SEC")
-			if drainingTimeEnv == "" {
-				log.Println("[VirtController] DRAINING_TIME is not defined, use fallback value: 30")
-				drainingTimeEnv = "30"
-			}
+	go func() {
+		inst.DeRegisterPromDiscovery()
+	}()
+
+	// the hook runs on the drained instance, e.g. to pull its logs
+	if m.runLifecycleHook(inst, LIFECYCLE_TRANSITION_TERMINATING) == LIFECYCLE_RESULT_ABANDON {
+		allowReuse = false
+	}
 
-			drainingTime, err := strconv.Atoi(drainingTimeEnv)
-			if err != nil {
-				log.Println(err)
-				return
+	if allowReuse {
+		for _, pool := range []*WarmPool{m.standby, m.warmPool} {
+			if !pool.reuseOnScaleIn() || !pool.hasRoom() {
+				continue
 			}
 
-			log.Printf("[VirtController] Draining connection %s\n", inst.GetID())
-			time.Sleep(time.Duration(drainingTime) * time.Second)
-		}()
+			m.Lock()
+			delete(m.MapInstanceIdToInstance, inst.GetID())
+			m.Unlock()
 
+			if err := pool.park(inst); err == nil && pool.put(inst) {
+				log.Printf("[VirtController] Parked %s in %s\n", inst.GetID(), pool.name)
+				return nil
+			}
+			break
+		}
 	}
 
-	go func() {
-		inst.DeRegisterPromDiscovery()
-	}()
-
 	if err := inst.Shutdown(); err != nil {
 		log.Println(err)
 		return err
 	}
+	log.Printf("[VirtController] Terminated %s via %s\n", inst.GetID(), inst.GetTerminationPath())
 
 	m.Lock()
 	delete(m.MapInstanceIdToInstance, inst.GetID())
@@ -226,6 +492,31 @@ func (m *VirtController) gracefullyShutdown(inst instance.InstanceManager, wg *s
 
 }
 
+// SetScaleInProtection keeps the instance out of scale-in, instance refresh
+// and lifetime recycling until the protection is removed.
+func (m *VirtController) SetScaleInProtection(instanceID string, protected bool) error {
+	m.Lock()
+	inst, ok := m.MapInstanceIdToInstance[instanceID]
+	m.Unlock()
+	if !ok {
+		return fmt.Errorf("instance %s is not in group %s", instanceID, m.getGroup().Name)
+	}
+
+	return inst.SetScaleInProtection(protected)
+}
+
+// GetInstances returns every instance of the group, whatever its state.
+func (m *VirtController) GetInstances() []instance.InstanceManager {
+	m.Lock()
+	defer m.Unlock()
+
+	instances := []instance.InstanceManager{}
+	for _, inst := range m.MapInstanceIdToInstance {
+		instances = append(instances, inst)
+	}
+	return instances
+}
+
 func (m *VirtController) GetRunningInstance() (int, []instance.InstanceManager, error) {
 	runningInstances := []instance.InstanceManager{}
 
@@ -244,9 +535,119 @@ func (m *VirtController) GetRunningInstance() (int, []instance.InstanceManager,
 
 }
 
+// GetRunningCapacity returns the weighted capacity of the running instances,
+// the unit of the group sizes.
+func (m *VirtController) GetRunningCapacity() int {
+	_, runningInstances, _ := m.GetRunningInstance()
+	return capacityOf(runningInstances)
+}
+
+// SelectScaleInCandidates picks numToRemove running instances so that the
+// fleet stays balanced across hosts. With spread placement instances are
+// taken from the most loaded host, with binpack from the least loaded one
+// so that hosts can be emptied, hosts with as many instances are taken in
+// order of their URI. Within a host the oldest instance goes first.
+// Instances protected from scale-in are never selected.
+func (m *VirtController) SelectScaleInCandidates(numToRemove int) []instance.InstanceManager {
+	_, runningInstances, _ := m.GetRunningInstance()
+
+	instancesByHost := make(map[string][]instance.InstanceManager)
+	for _, inst := range runningInstances {
+		if inst.IsScaleInProtected() {
+			continue
+		}
+		instancesByHost[inst.GetHost()] = append(instancesByHost[inst.GetHost()], inst)
+	}
+
+	for hostURI := range instancesByHost {
+		slices.SortFunc(instancesByHost[hostURI], func(a, b instance.InstanceManager) int {
+			return a.GetBootTime().Compare(b.GetBootTime())
+		})
+	}
+
+	// the first host in URI order wins a tie
+	hostURIs := slices.Sorted(maps.Keys(instancesByHost))
+
+	candidates := []instance.InstanceManager{}
+	for len(candidates) < numToRemove {
+		selectedHost := ""
+		for _, hostURI := range hostURIs {
+			instances := instancesByHost[hostURI]
+			if len(instances) == 0 {
+				continue
+			}
+
+			if selectedHost == "" {
+				selectedHost = hostURI
+				continue
+			}
+
+			selectedCount := len(instancesByHost[selectedHost])
+			if m.scheduler.Strategy() == host.PLACEMENT_STRATEGY_BINPACK {
+				if len(instances) < selectedCount {
+					selectedHost = hostURI
+				}
+			} else if len(instances) > selectedCount {
+				selectedHost = hostURI
+			}
+		}
+
+		if selectedHost == "" {
+			break
+		}
+
+		candidates = append(candidates, instancesByHost[selectedHost][0])
+		instancesByHost[selectedHost] = instancesByHost[selectedHost][1:]
+	}
+
+	return candidates
+}
+
+func (m *VirtController) Run() {
+	fastBootMode := FastBootMode(helper.GetEnv("FAST_BOOT_MODE", string(FAST_BOOT_MODE_COLD)))
+	if fastBootMode == FAST_BOOT_MODE_SNAPSHOT {
+		go func() {
+			if err := m.prepareGoldenImage(); err != nil {
+				log.Printf("[VirtController] Failed to prepare golden image, keep cold boot: %v\n", err)
+			}
+		}()
+		go m.runGoldenImageCleanup(time.Minute)
+	}
+
+	m.warmPool.LoadFromEnv()
+	if m.warmPool.Enabled() {
+		go m.runWarmPool(30 * time.Second)
+	}
+
+	m.standby.LoadStandbyFromEnv()
+	if m.standby.Enabled() {
+		go m.runStandbyExpiry(time.Minute)
+	}
+
+	if helper.GetEnvBool("HEALTH_REPLACEMENT_ENABLED", true) {
+		go m.runHealthReplacement(30 * time.Second)
+	}
+
+	go m.runLifetimeRecycling(time.Minute)
+
+	for _, h := range m.scheduler.Hosts() {
+		// domains are adopted once, when the host is first reachable. Later
+		// on they include the instances being launched, parked in a pool or
+		// prepared as golden instance, which are not in the map yet.
+		adopted := m.adoptInstances(h)
+		h.Subscribe(m.onDomainEvent)
+		h.OnReconnect(func() {
+			m.refreshDomains(h)
+			if !adopted {
+				adopted = m.adoptInstances(h)
+			}
+		})
+	}
+}
+
+// Close stops managing the group, the host connections are shared between
+// groups and closed by their owner.
 func (m *VirtController) Close() {
-	log.Println("[VirtController] Closing virt connection")
-	m.conn.Close()
-	log.Println("[VirtController] Closed virt connection")
+	log.Printf("[VirtController] Closed group %s\n", m.getGroup().Name)
 
 }
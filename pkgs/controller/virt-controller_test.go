@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/host"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+)
+
+// testInstance is a running instance on a host, the methods scale-in does
+// not use are left unimplemented.
+type testInstance struct {
+	instance.InstanceManager
+	id        string
+	host      string
+	bootTime  time.Time
+	protected bool
+}
+
+func (i *testInstance) GetStatus() instance.VMState { return instance.VM_STATE_RUNNING }
+func (i *testInstance) GetID() string               { return i.id }
+func (i *testInstance) GetHost() string             { return i.host }
+func (i *testInstance) GetBootTime() time.Time      { return i.bootTime }
+func (i *testInstance) IsScaleInProtected() bool    { return i.protected }
+
+// newTestController runs the instances, named by host and boot order, e.g.
+// a-0 is the oldest instance on host a.
+func newTestController(strategy host.PlacementStrategy, instancesByHost map[string]int) *VirtController {
+	scheduler := host.NewScheduler(nil, strategy, host.AdmissionPolicy{})
+	m := NewVirtController(scheduler, NewLaunchQueue(1, 0, 0), GroupConfig{Name: "test"}, 0, 0)
+
+	booted := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for hostURI, count := range instancesByHost {
+		for i := 0; i < count; i++ {
+			inst := &testInstance{
+				id:       fmt.Sprintf("%s-%d", hostURI, i),
+				host:     hostURI,
+				bootTime: booted.Add(time.Duration(i) * time.Hour),
+			}
+			m.MapInstanceIdToInstance[inst.id] = inst
+		}
+	}
+	return m
+}
+
+func candidateIDs(candidates []instance.InstanceManager) []string {
+	ids := []string{}
+	for _, inst := range candidates {
+		ids = append(ids, inst.GetID())
+	}
+	return ids
+}
+
+func expectCandidates(t *testing.T, candidates []instance.InstanceManager, want ...string) {
+	t.Helper()
+
+	got := candidateIDs(candidates)
+	if len(got) != len(want) {
+		t.Fatalf("selected %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("selected %v, want %v", got, want)
+		}
+	}
+}
+
+func TestScaleInWithSpreadTakesFromTheMostLoadedHost(t *testing.T) {
+	m := newTestController(host.PLACEMENT_STRATEGY_SPREAD, map[string]int{"a": 4, "b": 2, "c": 1})
+
+	// a is brought down to the size of b, oldest instance first
+	expectCandidates(t, m.SelectScaleInCandidates(2), "a-0", "a-1")
+}
+
+func TestScaleInWithBinpackEmptiesTheLeastLoadedHost(t *testing.T) {
+	m := newTestController(host.PLACEMENT_STRATEGY_BINPACK, map[string]int{"a": 4, "b": 2, "c": 1})
+
+	// c is emptied first, then b
+	expectCandidates(t, m.SelectScaleInCandidates(3), "c-0", "b-0", "b-1")
+}
+
+func TestScaleInSkipsProtectedInstances(t *testing.T) {
+	for _, strategy := range []host.PlacementStrategy{host.PLACEMENT_STRATEGY_SPREAD, host.PLACEMENT_STRATEGY_BINPACK} {
+		m := newTestController(strategy, map[string]int{"a": 3, "b": 1})
+		m.MapInstanceIdToInstance["a-0"].(*testInstance).protected = true
+		m.MapInstanceIdToInstance["b-0"].(*testInstance).protected = true
+
+		// only the unprotected instances of a are left, fewer than asked
+		// for, whichever host the strategy prefers
+		expectCandidates(t, m.SelectScaleInCandidates(3), "a-1", "a-2")
+	}
+}
+
+func TestScaleInBreaksTiesByHostURI(t *testing.T) {
+	for _, strategy := range []host.PlacementStrategy{host.PLACEMENT_STRATEGY_SPREAD, host.PLACEMENT_STRATEGY_BINPACK} {
+		m := newTestController(strategy, map[string]int{"c": 2, "a": 2, "b": 2})
+
+		// every host has as many instances each round, so they take turns
+		// with spread and are emptied one after the other with binpack
+		want := []string{"a-0", "b-0", "c-0", "a-1"}
+		if strategy == host.PLACEMENT_STRATEGY_BINPACK {
+			want = []string{"a-0", "a-1", "b-0", "b-1"}
+		}
+		for i := 0; i < 20; i++ {
+			expectCandidates(t, m.SelectScaleInCandidates(4), want...)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package controller
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"github.com/linlynnn/kvm-autoscaler/pkgs/instance"
+)
+
+type WarmPoolState string
+
+const (
+	WARM_POOL_STATE_STOPPED WarmPoolState = "stopped"
+	WARM_POOL_STATE_PAUSED  WarmPoolState = "paused"
+	WARM_POOL_STATE_SAVED   WarmPoolState = "saved"
+)
+
+// WarmPool keeps provisioned instances parked so that ScaleUp can resume
+// them in seconds instead of waiting for a cold start. The standby pool is a
+// WarmPool that is only filled by scale-in.
+type WarmPool struct {
+	sync.Mutex
+	name           string
+	instances      []instance.InstanceManager
+	parkedAt       map[string]time.Time
+	provisioning   int
+	MinSize        int
+	MaxSize        int
+	State          WarmPoolState
+	ReuseOnScaleIn bool
+	// IdleExpiry terminates instances parked for longer, zero keeps them
+	IdleExpiry time.Duration
+}
+
+func NewWarmPool(name string) *WarmPool {
+	return &WarmPool{
+		name:      name,
+		instances: []instance.InstanceManager{},
+		parkedAt:  make(map[string]time.Time),
+		State:     WARM_POOL_STATE_STOPPED,
+	}
+}
+
+// LoadFromEnv reads the WARM_POOL_* settings, a pool with a zero max size is
+// disabled.
+func (p *WarmPool) LoadFromEnv() {
+	minSize := helper.GetEnvInt("WARM_POOL_MIN_SIZE", 0)
+	maxSize := helper.GetEnvInt("WARM_POOL_MAX_SIZE", minSize)
+	if maxSize < minSize {
+		log.Printf("[WarmPool] WARM_POOL_MAX_SIZE %d is lower than WARM_POOL_MIN_SIZE, use %d\n", maxSize, minSize)
+		maxSize = minSize
+	}
+
+	state := WarmPoolState(helper.GetEnv("WARM_POOL_STATE", string(WARM_POOL_STATE_STOPPED)))
+	switch state {
+	case WARM_POOL_STATE_STOPPED, WARM_POOL_STATE_PAUSED, WARM_POOL_STATE_SAVED:
+	default:
+		log.Printf("[WarmPool] Unknown WARM_POOL_STATE %s, use fallback value: %s\n", state, WARM_POOL_STATE_STOPPED)
+		state = WARM_POOL_STATE_STOPPED
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.MinSize = minSize
+	p.MaxSize = maxSize
+	p.State = state
+	p.ReuseOnScaleIn = helper.GetEnvBool("WARM_POOL_REUSE_ON_SCALE_IN", false)
+}
+
+type StandbyMode string
+
+const (
+	STANDBY_MODE_OFF          StandbyMode = "off"
+	STANDBY_MODE_SUSPEND      StandbyMode = "suspend"
+	STANDBY_MODE_MANAGED_SAVE StandbyMode = "managed-save"
+)
+
+// LoadStandbyFromEnv reads the STANDBY_* settings. Scale-in parks up to
+// STANDBY_MAX_SIZE instances suspended or managed-saved, and a later
+// scale-out resumes them before anything else.
+func (p *WarmPool) LoadStandbyFromEnv() {
+	mode := StandbyMode(helper.GetEnv("STANDBY_MODE", string(STANDBY_MODE_OFF)))
+
+	state := WARM_POOL_STATE_PAUSED
+	maxSize := helper.GetEnvInt("STANDBY_MAX_SIZE", 5)
+	switch mode {
+	case STANDBY_MODE_SUSPEND:
+	case STANDBY_MODE_MANAGED_SAVE:
+		state = WARM_POOL_STATE_SAVED
+	case STANDBY_MODE_OFF:
+		maxSize = 0
+	default:
+		log.Printf("[Standby] Unknown STANDBY_MODE %s, use fallback value: %s\n", mode, STANDBY_MODE_OFF)
+		maxSize = 0
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.MinSize = 0
+	p.MaxSize = maxSize
+	p.State = state
+	p.ReuseOnScaleIn = true
+	p.IdleExpiry = time.Duration(helper.GetEnvInt("STANDBY_IDLE_EXPIRY_MIN", 60)) * time.Minute
+}
+
+func (p *WarmPool) Enabled() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.MaxSize > 0
+}
+
+func (p *WarmPool) reuseOnScaleIn() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.ReuseOnScaleIn
+}
+
+func (p *WarmPool) state() WarmPoolState {
+	p.Lock()
+	defer p.Unlock()
+	return p.State
+}
+
+func (p *WarmPool) Size() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.instances)
+}
+
+// list returns the parked instances without taking them.
+func (p *WarmPool) list() []instance.InstanceManager {
+	p.Lock()
+	defer p.Unlock()
+	return append([]instance.InstanceManager{}, p.instances...)
+}
+
+// remove drops an instance that no longer exists from the pool.
+func (p *WarmPool) remove(inst instance.InstanceManager) {
+	p.Lock()
+	defer p.Unlock()
+	p.instances = slices.DeleteFunc(p.instances, func(parked instance.InstanceManager) bool {
+		return parked.GetID() == inst.GetID()
+	})
+	delete(p.parkedAt, inst.GetID())
+}
+
+// expired removes and returns the instances parked for longer than
+// IdleExpiry.
+func (p *WarmPool) expired() []instance.InstanceManager {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.IdleExpiry <= 0 {
+		return nil
+	}
+
+	expired := []instance.InstanceManager{}
+	kept := []instance.InstanceManager{}
+	for _, inst := range p.instances {
+		if time.Since(p.parkedAt[inst.GetID()]) > p.IdleExpiry {
+			expired = append(expired, inst)
+			delete(p.parkedAt, inst.GetID())
+		} else {
+			kept = append(kept, inst)
+		}
+	}
+	p.instances = kept
+	return expired
+}
+
+// take removes up to n parked instances from the pool.
+func (p *WarmPool) take(n int) []instance.InstanceManager {
+	p.Lock()
+	defer p.Unlock()
+
+	if n > len(p.instances) {
+		n = len(p.instances)
+	}
+
+	taken := p.instances[:n]
+	p.instances = append([]instance.InstanceManager{}, p.instances[n:]...)
+	for _, inst := range taken {
+		delete(p.parkedAt, inst.GetID())
+	}
+	return taken
+}
+
+func (p *WarmPool) hasRoom() bool {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.instances)+p.provisioning < p.MaxSize
+}
+
+// put adds a parked instance, returning false when the pool is full.
+func (p *WarmPool) put(inst instance.InstanceManager) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.instances)+p.provisioning >= p.MaxSize {
+		return false
+	}
+	p.instances = append(p.instances, inst)
+	p.parkedAt[inst.GetID()] = time.Now()
+	return true
+}
+
+// reserve returns how many new instances are needed to reach MinSize and
+// counts them as provisioning.
+func (p *WarmPool) reserve() int {
+	p.Lock()
+	defer p.Unlock()
+
+	missing := p.MinSize - len(p.instances) - p.provisioning
+	if missing < 0 {
+		missing = 0
+	}
+	p.provisioning += missing
+	return missing
+}
+
+func (p *WarmPool) release(inst instance.InstanceManager) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.provisioning--
+	if inst != nil {
+		p.instances = append(p.instances, inst)
+		p.parkedAt[inst.GetID()] = time.Now()
+	}
+}
+
+func (p *WarmPool) park(inst instance.InstanceManager) error {
+	switch p.state() {
+	case WARM_POOL_STATE_PAUSED:
+		return inst.Suspend()
+	case WARM_POOL_STATE_SAVED:
+		return inst.ManagedSave()
+	}
+	return inst.Stop()
+}
+
+func (p *WarmPool) wake(inst instance.InstanceManager) error {
+	if p.state() == WARM_POOL_STATE_PAUSED {
+		return inst.Resume()
+	}
+	return inst.Start()
+}
+
+func (m *VirtController) runWarmPool(interval time.Duration) {
+	log.Printf("[WarmPool] Keeping %d-%d instances %s\n", m.warmPool.MinSize, m.warmPool.MaxSize, m.warmPool.state())
+
+	for {
+		missing := m.warmPool.reserve()
+		for i := 0; i < missing; i++ {
+			go m.provisionWarmInstance()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// provisionWarmInstance launches an instance of the primary type, the one
+// the golden image is built from, and parks it.
+func (m *VirtController) provisionWarmInstance() {
+	group := m.getGroup()
+	primary := group.primaryType()
+	h, err := m.placeInstance(group, primary)
+	if err != nil {
+		log.Printf("[WarmPool] Failed to place warm instance: %v\n", err)
+		m.warmPool.release(nil)
+		return
+	}
+	// the quota reservation is held until the instance is in the pool
+	defer m.releaseQuota(usageOf(group.request(primary)))
+
+	instanceMng, err := m.launchVM(h, group, primary)
+	if err != nil {
+		m.warmPool.release(nil)
+		return
+	}
+
+	// parking a half-provisioned instance would freeze cloud-init
+	if err := instanceMng.WaitUntilReady(context.Background()); err != nil {
+		log.Printf("[WarmPool] Drop %s: %v\n", instanceMng.GetID(), err)
+		instanceMng.Shutdown()
+		m.warmPool.release(nil)
+		return
+	}
+
+	if err := m.warmPool.park(instanceMng); err != nil {
+		instanceMng.Shutdown()
+		m.warmPool.release(nil)
+		return
+	}
+
+	m.warmPool.release(instanceMng)
+	log.Printf("[WarmPool] Added %s to warm pool\n", instanceMng.GetID())
+}
+
+// runStandbyExpiry terminates standby instances that were not resumed in
+// time, so they do not hold host memory or disk forever.
+func (m *VirtController) runStandbyExpiry(interval time.Duration) {
+	log.Printf("[Standby] Keeping up to %d instances %s for %v\n", m.standby.MaxSize, m.standby.state(), m.standby.IdleExpiry)
+
+	for {
+		time.Sleep(interval)
+		for _, inst := range m.standby.expired() {
+			log.Printf("[Standby] %s expired after %v idle\n", inst.GetID(), m.standby.IdleExpiry)
+			if err := inst.Shutdown(); err != nil {
+				log.Printf("[Standby] Failed to terminate %s: %v\n", inst.GetID(), err)
+			}
+		}
+	}
+}
+
+func (m *VirtController) activateWarmInstance(pool *WarmPool, inst instance.InstanceManager, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	log.Printf("["+pool.name+"] Activating %s\n", inst.GetID())
+
+	// stopped and saved instances give their memory back to the host, so they
+	// go through admission again before they start
+	h := m.scheduler.Host(inst.GetHost())
+	req := m.getGroup().request(m.getGroup().typeOf(inst))
+	req.DiskMiB = 0
+	if pool.state() != WARM_POOL_STATE_PAUSED {
+		if err := m.scheduler.Reserve(h, req); err != nil {
+			log.Printf("["+pool.name+"] Keep %s parked: %v\n", inst.GetID(), err)
+			if !pool.put(inst) {
+				inst.Shutdown()
+			}
+			return
+		}
+		defer m.scheduler.Done(h, req)
+	}
+
+	if err := pool.wake(inst); err != nil {
+		// a broken pooled instance is replaced by a cold start
+		inst.Shutdown()
+		h, fleetType, err := m.placeLike(inst)
+		if err != nil {
+			log.Printf("["+pool.name+"] Failed to replace %s: %v\n", inst.GetID(), err)
+			return
+		}
+		wg.Add(1)
+		m.createVM(h, fleetType, wg)
+		return
+	}
+
+	m.Lock()
+	m.MapInstanceIdToInstance[inst.GetID()] = inst
+	m.Unlock()
+
+	m.registerInstance(inst)
+	log.Printf("["+pool.name+"] Activated %s\n", inst.GetID())
+}
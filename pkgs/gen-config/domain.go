@@ -0,0 +1,474 @@
+package genconfig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+)
+
+// Domain is the libvirt domain XML of an instance, see
+// https://libvirt.org/formatdomain.html. Only the elements the autoscaler
+// sets are modelled, anything else goes through a domain XML template.
+type Domain struct {
+	XMLName       xml.Name        `xml:"domain"`
+	Type          string          `xml:"type,attr"`
+	Name          string          `xml:"name"`
+	Metadata      *DomainMetadata `xml:"metadata"`
+	Memory        DomainMemory    `xml:"memory"`
+	CurrentMemory DomainMemory    `xml:"currentMemory"`
+	Vcpu          DomainVcpu      `xml:"vcpu"`
+	OS            DomainOS        `xml:"os"`
+	Features      DomainFeatures  `xml:"features"`
+	CPU           DomainCPU       `xml:"cpu"`
+	Clock         DomainClock     `xml:"clock"`
+	OnPoweroff    string          `xml:"on_poweroff"`
+	OnReboot      string          `xml:"on_reboot"`
+	OnCrash       string          `xml:"on_crash"`
+	Devices       DomainDevices   `xml:"devices"`
+}
+
+// DomainMetadata holds namespaced elements, such as the instance metadata,
+// as raw XML.
+type DomainMetadata struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+type DomainMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value uint64 `xml:",chardata"`
+}
+
+// DomainVcpu is the maximum of vCPUs, Current of them are plugged at boot.
+type DomainVcpu struct {
+	Placement string `xml:"placement,attr,omitempty"`
+	Current   uint   `xml:"current,attr,omitempty"`
+	Value     uint   `xml:",chardata"`
+}
+
+type DomainOS struct {
+	Type DomainOSType `xml:"type"`
+}
+
+type DomainOSType struct {
+	Arch    string `xml:"arch,attr,omitempty"`
+	Machine string `xml:"machine,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+// DomainFlag is an empty element that is set by being present.
+type DomainFlag struct{}
+
+type DomainFeatures struct {
+	ACPI *DomainFlag `xml:"acpi"`
+	APIC *DomainFlag `xml:"apic"`
+	PAE  *DomainFlag `xml:"pae"`
+}
+
+type DomainCPU struct {
+	Mode  string          `xml:"mode,attr"`
+	Model *DomainCPUModel `xml:"model"`
+}
+
+type DomainCPUModel struct {
+	Fallback string `xml:"fallback,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+type DomainClock struct {
+	Offset string `xml:"offset,attr"`
+}
+
+type DomainDevices struct {
+	Channels   []DomainChannel   `xml:"channel"`
+	Disks      []DomainDisk      `xml:"disk"`
+	Interfaces []DomainInterface `xml:"interface"`
+	Consoles   []DomainChar      `xml:"console"`
+	Serials    []DomainChar      `xml:"serial"`
+}
+
+type DomainChannel struct {
+	Type   string              `xml:"type,attr"`
+	Source DomainChannelSource `xml:"source"`
+	Target DomainChannelTarget `xml:"target"`
+}
+
+type DomainChannelSource struct {
+	Mode string `xml:"mode,attr,omitempty"`
+	Path string `xml:"path,attr,omitempty"`
+}
+
+type DomainChannelTarget struct {
+	Type string `xml:"type,attr"`
+	Name string `xml:"name,attr,omitempty"`
+}
+
+type DomainDisk struct {
+	Type     string           `xml:"type,attr"`
+	Device   string           `xml:"device,attr"`
+	Driver   DomainDiskDriver `xml:"driver"`
+	Source   DomainDiskSource `xml:"source"`
+	Target   DomainDiskTarget `xml:"target"`
+	ReadOnly *DomainFlag      `xml:"readonly"`
+}
+
+type DomainDiskDriver struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// DomainDiskSource is a file, a block device or a storage pool volume
+// depending on the disk type.
+type DomainDiskSource struct {
+	File   string `xml:"file,attr,omitempty"`
+	Dev    string `xml:"dev,attr,omitempty"`
+	Pool   string `xml:"pool,attr,omitempty"`
+	Volume string `xml:"volume,attr,omitempty"`
+}
+
+type DomainDiskTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr"`
+}
+
+type DomainInterface struct {
+	Type   string                `xml:"type,attr"`
+	MAC    *DomainInterfaceMAC   `xml:"mac"`
+	Source DomainInterfaceSource `xml:"source"`
+	Model  DomainInterfaceModel  `xml:"model"`
+}
+
+type DomainInterfaceMAC struct {
+	Address string `xml:"address,attr"`
+}
+
+type DomainInterfaceSource struct {
+	Network string `xml:"network,attr,omitempty"`
+	Bridge  string `xml:"bridge,attr,omitempty"`
+}
+
+type DomainInterfaceModel struct {
+	Type string `xml:"type,attr"`
+}
+
+// DomainChar is a console or serial device.
+type DomainChar struct {
+	Type   string           `xml:"type,attr"`
+	Target DomainCharTarget `xml:"target"`
+}
+
+type DomainCharTarget struct {
+	Type string `xml:"type,attr,omitempty"`
+	Port uint   `xml:"port,attr"`
+}
+
+// NewInstanceDomain builds the domain of instance id, which boots from
+// overlay with the NoCloud seed volume attached as a cdrom, with memoryMiB
+// and vcpus and can be hot-plugged up to
+// maxMemoryMiB and maxVcpus. metadata is a namespaced element written into
+// the domain <metadata>. The machine type, the CPU and the network come from
+// DOMAIN_MACHINE_TYPE, DOMAIN_CPU_MODE, DOMAIN_CPU_MODEL and DOMAIN_NETWORK.
+func NewInstanceDomain(
+	id string,
+	overlay OverlayVolume,
+	seed OverlayVolume,
+	memoryMiB uint64,
+	maxMemoryMiB uint64,
+	vcpus uint,
+	maxVcpus uint,
+	metadata string,
+) *Domain {
+	cpu := DomainCPU{Mode: helper.GetEnv("DOMAIN_CPU_MODE", "host-model")}
+	if model := helper.GetEnv("DOMAIN_CPU_MODEL", ""); model != "" {
+		cpu = DomainCPU{Mode: "custom", Model: &DomainCPUModel{Fallback: "forbid", Value: model}}
+	}
+
+	domain := &Domain{
+		Type:          "kvm",
+		Name:          "instance-" + id,
+		Memory:        DomainMemory{Unit: "MiB", Value: max(memoryMiB, maxMemoryMiB)},
+		CurrentMemory: DomainMemory{Unit: "MiB", Value: memoryMiB},
+		Vcpu:          DomainVcpu{Placement: "static", Current: vcpus, Value: max(vcpus, maxVcpus)},
+		OS: DomainOS{
+			Type: DomainOSType{Arch: "x86_64", Machine: helper.GetEnv("DOMAIN_MACHINE_TYPE", "pc"), Value: "hvm"},
+		},
+		Features: DomainFeatures{
+			ACPI: &DomainFlag{},
+			APIC: &DomainFlag{},
+			PAE:  &DomainFlag{},
+		},
+		CPU:        cpu,
+		Clock:      DomainClock{Offset: "utc"},
+		OnPoweroff: "destroy",
+		OnReboot:   "restart",
+		OnCrash:    "restart",
+		Devices: DomainDevices{
+			Channels: []DomainChannel{{
+				Type:   "unix",
+				Source: DomainChannelSource{Mode: "bind", Path: "/var/lib/libvirt/qemu/ga-socket-" + id + ".agent"},
+				Target: DomainChannelTarget{Type: "virtio", Name: "org.qemu.guest_agent.0"},
+			}},
+			Disks: []DomainDisk{
+				{
+					Type:   "volume",
+					Device: "disk",
+					Driver: DomainDiskDriver{Name: "qemu", Type: overlay.Format},
+					Source: DomainDiskSource{Pool: overlay.Pool, Volume: overlay.Name},
+					Target: DomainDiskTarget{Dev: "vda", Bus: "virtio"},
+				},
+				{
+					Type:     "volume",
+					Device:   "cdrom",
+					Driver:   DomainDiskDriver{Name: "qemu", Type: seed.Format},
+					Source:   DomainDiskSource{Pool: seed.Pool, Volume: seed.Name},
+					Target:   DomainDiskTarget{Dev: "hdb", Bus: "ide"},
+					ReadOnly: &DomainFlag{},
+				},
+			},
+			Interfaces: []DomainInterface{{
+				Type:   "network",
+				Source: DomainInterfaceSource{Network: helper.GetEnv("DOMAIN_NETWORK", "default")},
+				Model:  DomainInterfaceModel{Type: "virtio"},
+			}},
+			Consoles: []DomainChar{{Type: "pty", Target: DomainCharTarget{Type: "serial", Port: 0}}},
+			Serials:  []DomainChar{{Type: "pty", Target: DomainCharTarget{Port: 0}}},
+		},
+	}
+
+	if metadata != "" {
+		domain.Metadata = &DomainMetadata{InnerXML: metadata}
+	}
+	return domain
+}
+
+// ParseDomain reads the modelled part of a domain XML.
+func ParseDomain(domainXML string) (*Domain, error) {
+	var domain Domain
+	if err := xml.Unmarshal([]byte(domainXML), &domain); err != nil {
+		return nil, err
+	}
+	return &domain, nil
+}
+
+var memoryUnitsKiB = map[string]uint64{
+	"":    1,
+	"k":   1,
+	"KiB": 1,
+	"M":   1024,
+	"MiB": 1024,
+	"G":   1024 * 1024,
+	"GiB": 1024 * 1024,
+}
+
+func (m DomainMemory) kib() (uint64, error) {
+	unit, ok := memoryUnitsKiB[m.Unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown memory unit %q", m.Unit)
+	}
+	return m.Value * unit, nil
+}
+
+var lifecycleActions = map[string]bool{
+	"destroy":          true,
+	"restart":          true,
+	"preserve":         true,
+	"rename-restart":   true,
+	"coredump-destroy": true,
+	"coredump-restart": true,
+}
+
+// Validate catches what libvirt would refuse or what breaks the autoscaler,
+// e.g. the hot-plug maximums below the boot size, before the domain is
+// defined.
+func (d *Domain) Validate() error {
+	if err := d.validate(); err != nil {
+		return fmt.Errorf("domain %s: %v", d.Name, err)
+	}
+	return nil
+}
+
+func (d *Domain) validate() error {
+	if d.Type != "kvm" && d.Type != "qemu" {
+		return fmt.Errorf("unsupported domain type %q", d.Type)
+	}
+
+	if d.Name == "" {
+		return fmt.Errorf("no name")
+	}
+
+	if d.Metadata != nil {
+		if err := wellFormed(d.Metadata.InnerXML); err != nil {
+			return fmt.Errorf("metadata: %v", err)
+		}
+	}
+
+	memory, err := d.Memory.kib()
+	if err != nil {
+		return err
+	}
+
+	currentMemory, err := d.CurrentMemory.kib()
+	if err != nil {
+		return err
+	}
+
+	if memory == 0 {
+		return fmt.Errorf("no memory")
+	}
+	if currentMemory > memory {
+		return fmt.Errorf("current memory %d KiB is above the maximum %d KiB", currentMemory, memory)
+	}
+
+	if d.Vcpu.Value == 0 {
+		return fmt.Errorf("no vCPUs")
+	}
+	if d.Vcpu.Current > d.Vcpu.Value {
+		return fmt.Errorf("%d current vCPUs are above the maximum %d", d.Vcpu.Current, d.Vcpu.Value)
+	}
+
+	if d.OS.Type.Value != "hvm" {
+		return fmt.Errorf("os type %q is not hvm", d.OS.Type.Value)
+	}
+
+	if d.CPU.Mode == "custom" && (d.CPU.Model == nil || d.CPU.Model.Value == "") {
+		return fmt.Errorf("custom cpu mode without a model")
+	}
+
+	for _, action := range []string{d.OnPoweroff, d.OnReboot, d.OnCrash} {
+		if action != "" && !lifecycleActions[action] {
+			return fmt.Errorf("unknown lifecycle action %q", action)
+		}
+	}
+
+	targets := make(map[string]bool)
+	for _, disk := range d.Devices.Disks {
+		if err := disk.validate(); err != nil {
+			return fmt.Errorf("disk %s: %v", disk.Target.Dev, err)
+		}
+		if targets[disk.Target.Dev] {
+			return fmt.Errorf("disk target %s is used twice", disk.Target.Dev)
+		}
+		targets[disk.Target.Dev] = true
+	}
+
+	for _, iface := range d.Devices.Interfaces {
+		switch {
+		case iface.Type == "network" && iface.Source.Network == "":
+			return fmt.Errorf("network interface without a network")
+		case iface.Type == "bridge" && iface.Source.Bridge == "":
+			return fmt.Errorf("bridge interface without a bridge")
+		}
+	}
+
+	for _, channel := range d.Devices.Channels {
+		if channel.Type == "unix" && channel.Source.Path == "" {
+			return fmt.Errorf("unix channel %s without a path", channel.Target.Name)
+		}
+	}
+
+	return nil
+}
+
+func (disk DomainDisk) validate() error {
+	if disk.Target.Dev == "" {
+		return fmt.Errorf("no target device")
+	}
+
+	if disk.Device != "disk" && disk.Device != "cdrom" {
+		return fmt.Errorf("unsupported device %q", disk.Device)
+	}
+
+	if disk.Driver.Type == "" {
+		return fmt.Errorf("no driver type")
+	}
+
+	switch disk.Type {
+	case "file":
+		if disk.Source.File == "" {
+			return fmt.Errorf("file disk without a file")
+		}
+	case "block":
+		if disk.Source.Dev == "" {
+			return fmt.Errorf("block disk without a device")
+		}
+	case "volume":
+		if disk.Source.Pool == "" || disk.Source.Volume == "" {
+			return fmt.Errorf("volume disk without a pool and volume")
+		}
+	default:
+		return fmt.Errorf("unsupported disk type %q", disk.Type)
+	}
+
+	return nil
+}
+
+// wellFormed checks that raw is a sequence of complete XML elements.
+func wellFormed(raw string) error {
+	decoder := xml.NewDecoder(strings.NewReader(raw))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// XML returns the domain XML to define.
+func (d *Domain) XML() (string, error) {
+	data, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// RenderDomainXML validates domain and returns its XML. domainXMLTemplate,
+// when set, is a text/template file executed with the Domain instead, e.g.
+// to add devices the Domain does not model, its output is checked the same
+// way and must keep the name and the metadata.
+func RenderDomainXML(domain *Domain, domainXMLTemplate string) (string, error) {
+	if err := domain.Validate(); err != nil {
+		return "", err
+	}
+
+	if domainXMLTemplate == "" {
+		return domain.XML()
+	}
+
+	tmpl, err := template.ParseFiles(domainXMLTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, path.Base(domainXMLTemplate), domain); err != nil {
+		return "", err
+	}
+
+	rendered, err := ParseDomain(buf.String())
+	if err != nil {
+		return "", fmt.Errorf("domain XML template %s: %v", domainXMLTemplate, err)
+	}
+
+	if rendered.Name != domain.Name {
+		return "", fmt.Errorf("domain XML template %s names the domain %q instead of %q", domainXMLTemplate, rendered.Name, domain.Name)
+	}
+
+	if domain.Metadata != nil && (rendered.Metadata == nil || !strings.Contains(rendered.Metadata.InnerXML, domain.Metadata.InnerXML)) {
+		return "", fmt.Errorf("domain XML template %s drops the instance metadata", domainXMLTemplate)
+	}
+
+	if err := rendered.Validate(); err != nil {
+		return "", fmt.Errorf("domain XML template %s: %v", domainXMLTemplate, err)
+	}
+
+	return buf.String(), nil
+}
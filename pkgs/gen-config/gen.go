@@ -1,69 +1,55 @@
 package genconfig
 
 import (
-	"fmt"
+	"bytes"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"text/template"
+	"time"
 
-	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	libvirt "libvirt.org/go/libvirt"
 )
 
-// overlay: {jammy-base-image}
-func GenQcow2DiskImage(id string) error {
-	//sudo qemu-img create -f qcow2 -b "$BASE_IMAGE" -F qcow2 "${IMG_REGISTRY}/${OVERLAY_IMAGE}" 5G
-	log.Println("Generating qcow2 disk-image:", id)
+// GenSeedVolume writes the NoCloud seed image of the instance into a volume
+// of poolName on conn, so that it is on the host the instance runs on.
+// network-config and vendor-data are added when CLOUD_INIT_NETWORK_CONFIG
+// and CLOUD_INIT_VENDOR_DATA name a file.
+func GenSeedVolume(conn *libvirt.Connect, poolName string, id string) (OverlayVolume, error) {
+	log.Println("Generating cloud-init seed volume:", id)
 
-	baseImageName := os.Getenv("BASE_IMAGE_NAME")
-	if baseImageName == "" {
-		baseImageName = "jammy-server-cloudimg-amd64.img"
+	sources := map[string]string{
+		"user-data":      "output/user-data/user-data-" + id,
+		"meta-data":      "output/meta-data/meta-data-" + id,
+		"network-config": os.Getenv("CLOUD_INIT_NETWORK_CONFIG"),
+		"vendor-data":    os.Getenv("CLOUD_INIT_VENDOR_DATA"),
 	}
 
-	if !helper.FileExists("/var/lib/libvirt/images/" + baseImageName) {
-		return fmt.Errorf("No base image exist")
-	}
-
-	cmd := exec.Command("sudo", "qemu-img", "create", "-f", "qcow2", "-b",
-		baseImageName,
-		"-F",
-		"qcow2",
-		"/var/lib/libvirt/images/overlay-"+id+".qcow2",
-	)
-
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return err
+	files := []ISOFile{}
+	for name, source := range sources {
+		if source == "" {
+			continue
+		}
 
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return OverlayVolume{}, err
+		}
+		files = append(files, ISOFile{Name: name, Data: data})
 	}
-	log.Println("Generated cloud-init cdrom:", id)
-	return nil
-
-}
-
-// config: {meta-data, user-data}
-func GenCdRomDiskImage(id string) error {
-	//sudo cloud-localds "${IMG_REGISTRY}/${CDROM_IMAGE}" "${USER_DIR}/${USER_DEST}" "${META_DIR}/${META_DEST}"
-	log.Println("Generating cloud-init cdrom:", id)
 
-	cmd := exec.Command("sudo", "cloud-localds",
-		"/var/lib/libvirt/images/cdrom-"+id+".iso",
-		"output/user-data/user-data-"+id,
-		"output/meta-data/meta-data-"+id,
-	)
-
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return err
+	var image bytes.Buffer
+	if err := WriteNoCloudISO(&image, files, time.Now()); err != nil {
+		return OverlayVolume{}, err
+	}
 
+	seed, err := uploadVolume(conn, poolName, SeedVolumeName(id), image.Bytes())
+	if err != nil {
+		return OverlayVolume{}, err
 	}
-	log.Println("Generated cloud-init cdrom:", id)
-	return nil
+
+	log.Println("Generated cloud-init seed volume:", id)
+	return seed, nil
 
 }
 
@@ -105,9 +91,12 @@ func GenMetaDataInstanceConfig(
 	return nil
 }
 
+// GenUserDataInstanceConfig renders the user-data of the instance from
+// userDataTemplate, or from the embedded template when it is empty.
 func GenUserDataInstanceConfig(
 	id string,
 	sshPublicKey string,
+	userDataTemplate string,
 ) error {
 
 	log.Println("Generating user-data: ", id)
@@ -121,6 +110,16 @@ func GenUserDataInstanceConfig(
 	if err != nil {
 		return err
 	}
+
+	templateName := "user-data.tmpl"
+	if userDataTemplate != "" {
+		tpl, err = template.ParseFiles(userDataTemplate)
+		if err != nil {
+			return err
+		}
+		templateName = path.Base(userDataTemplate)
+	}
+
 	metaData := map[string]string{
 		"HOSTNAME":       "instance-" + id,
 		"SSH_PUBLIC_KEY": sshPublicKey,
@@ -134,7 +133,7 @@ func GenUserDataInstanceConfig(
 	}
 	defer outFile.Close()
 
-	err = tpl.ExecuteTemplate(outFile, "user-data.tmpl", metaData)
+	err = tpl.ExecuteTemplate(outFile, templateName, metaData)
 	if err != nil {
 		return nil
 	}
@@ -144,55 +143,26 @@ func GenUserDataInstanceConfig(
 	return nil
 }
 
-func GenVirtInstanceConfig(
-	id string,
-
-) (string, error) {
+// GenVirtInstanceConfig validates domain and writes its XML, rendered from
+// domainXMLTemplate when set, see RenderDomainXML.
+func GenVirtInstanceConfig(domain *Domain, domainXMLTemplate string) (string, error) {
 
-	log.Println("Generating virt config: ", id)
+	log.Println("Generating virt config: ", domain.Name)
 	err := os.MkdirAll("output/virt-config", 0755)
 	if err != nil {
 		return "", err
 	}
 
-	virtTemplate := GetVirtTemplate()
-	virtTmpl, err := template.New("virt-config").Parse(virtTemplate)
+	domainXML, err := RenderDomainXML(domain, domainXMLTemplate)
 	if err != nil {
 		return "", err
 	}
 
-	instanceMemory := os.Getenv("INSTANCE_MEMORY")
-	if instanceMemory == "" {
-		instanceMemory = "2048"
-	}
-
-	instanceVcpu := os.Getenv("INSTANCE_VCPU")
-	if instanceVcpu == "" {
-		instanceVcpu = "2"
-	}
-
-	virtData := map[string]string{
-		"DOMAIN_NAME":     "instance-" + id,
-		"GA_SOCKET_NAME":  "ga-socket-" + id,
-		"OVERLAY_IMAGE":   "overlay-" + id,
-		"CDROM_IMAGE":     "cdrom-" + id,
-		"INSTANCE_MEMORY": instanceMemory,
-		"INSTANCE_VCPU":   instanceVcpu,
-	}
-
-	outputFileName := "instance-" + id
-	outputFilePath := path.Join("output/virt-config", outputFileName)
-	outFile, err := os.Create(outputFilePath)
-	if err != nil {
+	outputFilePath := path.Join("output/virt-config", domain.Name)
+	if err := os.WriteFile(outputFilePath, []byte(domainXML), 0644); err != nil {
 		return "", err
 	}
-	defer outFile.Close()
-
-	err = virtTmpl.Execute(outFile, virtData)
-	if err != nil {
-		return "", nil
-	}
-	log.Println("Generated xml config: ", id)
+	log.Println("Generated xml config: ", domain.Name)
 
 	return outputFilePath, nil
 }
@@ -0,0 +1,261 @@
+package genconfig
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NOCLOUD_VOLUME_ID is the label cloud-init's NoCloud datasource looks for.
+const NOCLOUD_VOLUME_ID = "cidata"
+
+const isoSectorSize = 2048
+
+// ISOFile is a file in the root directory of the seed image.
+type ISOFile struct {
+	Name string
+	Data []byte
+}
+
+// The layout is fixed, the root directory and the path tables fit into one
+// sector each since the image only holds the few NoCloud files:
+//
+//	0-15   system area
+//	16     primary volume descriptor
+//	17     Joliet supplementary volume descriptor
+//	18     volume descriptor set terminator
+//	19-20  primary L and M path tables
+//	21-22  Joliet L and M path tables
+//	23     primary root directory
+//	24     Joliet root directory
+//	25-    file data, each file starting on a new sector
+const (
+	isoPrimaryPathTableL = 19
+	isoPrimaryPathTableM = 20
+	isoJolietPathTableL  = 21
+	isoJolietPathTableM  = 22
+	isoPrimaryRoot       = 23
+	isoJolietRoot        = 24
+	isoFirstFile         = 25
+)
+
+// WriteNoCloudISO writes an ISO9660 image labelled cidata with files in its
+// root directory, as cloud-localds does. The primary directory has ISO9660
+// names, the Joliet directory the real ones, which Linux mounts prefer.
+// The output only depends on files and recorded, so it is reproducible.
+func WriteNoCloudISO(w io.Writer, files []ISOFile, recorded time.Time) error {
+	files = slices.Clone(files)
+	slices.SortFunc(files, func(a, b ISOFile) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	extents := make([]uint32, len(files))
+	next := uint32(isoFirstFile)
+	for i, file := range files {
+		extents[i] = next
+		next += sectorsOf(len(file.Data))
+	}
+	volumeSectors := next
+
+	primaryRoot, err := isoRootDirectory(isoPrimaryRoot, files, extents, recorded, primaryName)
+	if err != nil {
+		return err
+	}
+
+	jolietRoot, err := isoRootDirectory(isoJolietRoot, files, extents, recorded, jolietName)
+	if err != nil {
+		return err
+	}
+
+	image := make([]byte, 0, int(volumeSectors)*isoSectorSize)
+	image = append(image, make([]byte, 16*isoSectorSize)...)
+	image = append(image, isoVolumeDescriptor(1, volumeSectors, isoPrimaryPathTableL, isoPrimaryPathTableM, isoPrimaryRoot, recorded)...)
+	image = append(image, isoVolumeDescriptor(2, volumeSectors, isoJolietPathTableL, isoJolietPathTableM, isoJolietRoot, recorded)...)
+	image = append(image, isoTerminator()...)
+	image = append(image, isoPathTable(isoPrimaryRoot, binary.LittleEndian)...)
+	image = append(image, isoPathTable(isoPrimaryRoot, binary.BigEndian)...)
+	image = append(image, isoPathTable(isoJolietRoot, binary.LittleEndian)...)
+	image = append(image, isoPathTable(isoJolietRoot, binary.BigEndian)...)
+	image = append(image, primaryRoot...)
+	image = append(image, jolietRoot...)
+	for _, file := range files {
+		image = append(image, padSector(file.Data)...)
+	}
+
+	_, err = w.Write(image)
+	return err
+}
+
+func sectorsOf(size int) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+func padSector(data []byte) []byte {
+	padded := make([]byte, int(sectorsOf(len(data)))*isoSectorSize)
+	copy(padded, data)
+	return padded
+}
+
+// primaryName maps a file name to ISO9660 d-characters with a version,
+// e.g. user-data to USER_DATA.;1.
+func primaryName(name string) []byte {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+
+	if !strings.Contains(mapped, ".") {
+		mapped += "."
+	}
+	return []byte(mapped + ";1")
+}
+
+// jolietName is the UCS-2 big endian file name.
+func jolietName(name string) []byte {
+	return ucs2(name)
+}
+
+func ucs2(s string) []byte {
+	var buf bytes.Buffer
+	for _, r := range utf16.Encode([]rune(s)) {
+		binary.Write(&buf, binary.BigEndian, r)
+	}
+	return buf.Bytes()
+}
+
+func putBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
+
+func putBothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:2], v)
+	binary.BigEndian.PutUint16(b[2:4], v)
+}
+
+// isoDirectoryRecord encodes a directory record, name 0x00 is the directory
+// itself and 0x01 its parent.
+func isoDirectoryRecord(name []byte, extent uint32, size uint32, directory bool, recorded time.Time) []byte {
+	length := 33 + len(name)
+	if length%2 == 1 {
+		length++
+	}
+
+	record := make([]byte, length)
+	record[0] = byte(length)
+	putBothEndian32(record[2:10], extent)
+	putBothEndian32(record[10:18], size)
+
+	recorded = recorded.UTC()
+	record[18] = byte(recorded.Year() - 1900)
+	record[19] = byte(recorded.Month())
+	record[20] = byte(recorded.Day())
+	record[21] = byte(recorded.Hour())
+	record[22] = byte(recorded.Minute())
+	record[23] = byte(recorded.Second())
+
+	if directory {
+		record[25] = 2
+	}
+	putBothEndian16(record[28:32], 1)
+	record[32] = byte(len(name))
+	copy(record[33:], name)
+	return record
+}
+
+func isoRootDirectory(extent uint32, files []ISOFile, extents []uint32, recorded time.Time, fileName func(string) []byte) ([]byte, error) {
+	directory := isoDirectoryRecord([]byte{0}, extent, isoSectorSize, true, recorded)
+	directory = append(directory, isoDirectoryRecord([]byte{1}, extent, isoSectorSize, true, recorded)...)
+	for i, file := range files {
+		directory = append(directory, isoDirectoryRecord(fileName(file.Name), extents[i], uint32(len(file.Data)), false, recorded)...)
+	}
+
+	if len(directory) > isoSectorSize {
+		return nil, fmt.Errorf("%d files do not fit into the root directory", len(files))
+	}
+	return padSector(directory), nil
+}
+
+// isoPathTable holds the root directory only.
+func isoPathTable(rootExtent uint32, order binary.ByteOrder) []byte {
+	table := make([]byte, isoSectorSize)
+	table[0] = 1
+	order.PutUint32(table[2:6], rootExtent)
+	order.PutUint16(table[6:8], 1)
+	return table
+}
+
+// isoTimestamp is the 17 byte volume descriptor date, digits and a zero
+// GMT offset.
+func isoTimestamp(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	return append([]byte(t.UTC().Format("20060102150405")+"00"), 0)
+}
+
+// isoVolumeDescriptor encodes the primary (type 1) or the Joliet
+// supplementary (type 2) volume descriptor.
+func isoVolumeDescriptor(descriptorType byte, volumeSectors uint32, pathTableL uint32, pathTableM uint32, rootExtent uint32, recorded time.Time) []byte {
+	descriptor := make([]byte, isoSectorSize)
+	descriptor[0] = descriptorType
+	copy(descriptor[1:6], "CD001")
+	descriptor[6] = 1
+
+	text := func(s string, size int) []byte {
+		if descriptorType == 2 {
+			field := bytes.Repeat([]byte{0, ' '}, size/2)
+			copy(field, ucs2(s))
+			return field
+		}
+		return []byte(s + strings.Repeat(" ", size-len(s)))
+	}
+
+	copy(descriptor[8:40], text("LINUX", 32))
+	copy(descriptor[40:72], text(NOCLOUD_VOLUME_ID, 32))
+	putBothEndian32(descriptor[80:88], volumeSectors)
+	if descriptorType == 2 {
+		// UCS-2 level 3
+		copy(descriptor[88:91], "%/E")
+	}
+	putBothEndian16(descriptor[120:124], 1)
+	putBothEndian16(descriptor[124:128], 1)
+	putBothEndian16(descriptor[128:132], isoSectorSize)
+	putBothEndian32(descriptor[132:140], 10)
+	binary.LittleEndian.PutUint32(descriptor[140:144], pathTableL)
+	binary.BigEndian.PutUint32(descriptor[148:152], pathTableM)
+	copy(descriptor[156:190], isoDirectoryRecord([]byte{0}, rootExtent, isoSectorSize, true, recorded))
+
+	copy(descriptor[190:318], text("", 128))
+	copy(descriptor[318:446], text("", 128))
+	copy(descriptor[446:574], text("", 128))
+	copy(descriptor[574:702], text("KVM-AUTOSCALER", 128))
+	copy(descriptor[702:739], text("", 37))
+	copy(descriptor[739:776], text("", 37))
+	copy(descriptor[776:813], text("", 37))
+
+	copy(descriptor[813:830], isoTimestamp(recorded))
+	copy(descriptor[830:847], isoTimestamp(recorded))
+	copy(descriptor[847:864], isoTimestamp(time.Time{}))
+	copy(descriptor[864:881], isoTimestamp(recorded))
+	descriptor[881] = 1
+	return descriptor
+}
+
+func isoTerminator() []byte {
+	descriptor := make([]byte, isoSectorSize)
+	descriptor[0] = 255
+	copy(descriptor[1:6], "CD001")
+	descriptor[6] = 1
+	return descriptor
+}
@@ -0,0 +1,295 @@
+package genconfig
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var testRecorded = time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+var testSeedFiles = []ISOFile{
+	{Name: "user-data", Data: []byte("#cloud-config\nhostname: instance-test\n")},
+	{Name: "meta-data", Data: []byte("instance-id: instance-test\nlocal-hostname: instance-test\n")},
+}
+
+func writeTestSeed(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := WriteNoCloudISO(&buf, testSeedFiles, testRecorded); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sector(image []byte, n int) []byte {
+	return image[n*isoSectorSize : (n+1)*isoSectorSize]
+}
+
+func bothEndian32(t *testing.T, b []byte) uint32 {
+	t.Helper()
+	le := binary.LittleEndian.Uint32(b[0:4])
+	if be := binary.BigEndian.Uint32(b[4:8]); le != be {
+		t.Fatalf("both-endian field is %d little endian and %d big endian", le, be)
+	}
+	return le
+}
+
+// testdata/nocloud-seed.iso was written by WriteNoCloudISO with go test
+// -update, the build machines have no genisoimage or xorriso to produce it.
+// It was checked independently with blkid -p, which cloud-init uses to find
+// the seed and reports TYPE iso9660, LABEL cidata and the Joliet extension,
+// and with bsdtar -tvf, which lists meta-data and user-data. The system
+// tools test repeats these checks wherever the tools are installed.
+func TestWriteNoCloudISOGolden(t *testing.T) {
+	image := writeTestSeed(t)
+	golden := filepath.Join("testdata", "nocloud-seed.iso")
+
+	if *updateGolden {
+		if err := os.WriteFile(golden, image, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(image, want) {
+		t.Fatalf("seed image differs from %s, run go test -update after checking the layout", golden)
+	}
+}
+
+func TestWriteNoCloudISOReadsWithSystemTools(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "seed.iso")
+	if err := os.WriteFile(image, writeTestSeed(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("blkid", func(t *testing.T) {
+		if _, err := exec.LookPath("blkid"); err != nil {
+			t.Skip("blkid is not installed")
+		}
+
+		for tag, want := range map[string]string{"TYPE": "iso9660", "LABEL": "cidata"} {
+			out, err := exec.Command("blkid", "-p", "-o", "value", "-s", tag, image).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(out)); got != want {
+				t.Fatalf("blkid reports %s %q, want %q", tag, got, want)
+			}
+		}
+	})
+
+	// the files are read through the Joliet names, as cloud-init does
+	extractors := []struct {
+		tool string
+		args func(name string) []string
+	}{
+		{"isoinfo", func(name string) []string { return []string{"-J", "-i", image, "-x", "/" + name} }},
+		{"bsdtar", func(name string) []string { return []string{"-x", "-O", "-f", image, name} }},
+	}
+
+	for _, extractor := range extractors {
+		t.Run(extractor.tool, func(t *testing.T) {
+			if _, err := exec.LookPath(extractor.tool); err != nil {
+				t.Skipf("%s is not installed", extractor.tool)
+			}
+
+			for _, file := range testSeedFiles {
+				out, err := exec.Command(extractor.tool, extractor.args(file.Name)...).Output()
+				if err != nil {
+					t.Fatalf("extract %s: %v", file.Name, err)
+				}
+				if !bytes.Equal(out, file.Data) {
+					t.Fatalf("%s reads %s as %q, want %q", extractor.tool, file.Name, out, file.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteNoCloudISOIsReproducible(t *testing.T) {
+	// the file order must not matter
+	reversed := []ISOFile{testSeedFiles[1], testSeedFiles[0]}
+
+	var buf bytes.Buffer
+	if err := WriteNoCloudISO(&buf, reversed, testRecorded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), writeTestSeed(t)) {
+		t.Fatal("seed image depends on the file order")
+	}
+}
+
+func TestWriteNoCloudISOLayout(t *testing.T) {
+	image := writeTestSeed(t)
+
+	// meta-data and user-data take one sector each after the root directories
+	if len(image) != 27*isoSectorSize {
+		t.Fatalf("image is %d bytes, want 27 sectors", len(image))
+	}
+
+	for i := 0; i < 16; i++ {
+		if !bytes.Equal(sector(image, i), make([]byte, isoSectorSize)) {
+			t.Fatalf("system area sector %d is not zero", i)
+		}
+	}
+
+	t.Run("primary volume descriptor", func(t *testing.T) {
+		pvd := sector(image, 16)
+		if pvd[0] != 1 || string(pvd[1:6]) != "CD001" || pvd[6] != 1 {
+			t.Fatalf("bad descriptor header % x", pvd[0:7])
+		}
+		if got := string(pvd[40:72]); got != "cidata"+string(bytes.Repeat([]byte(" "), 26)) {
+			t.Fatalf("volume id is %q", got)
+		}
+		if got := bothEndian32(t, pvd[80:88]); got != 27 {
+			t.Fatalf("volume space size is %d, want 27", got)
+		}
+		if got := binary.LittleEndian.Uint16(pvd[128:130]); got != isoSectorSize {
+			t.Fatalf("logical block size is %d", got)
+		}
+		if got := binary.LittleEndian.Uint32(pvd[140:144]); got != isoPrimaryPathTableL {
+			t.Fatalf("L path table at %d", got)
+		}
+		if got := binary.BigEndian.Uint32(pvd[148:152]); got != isoPrimaryPathTableM {
+			t.Fatalf("M path table at %d", got)
+		}
+		if got := bothEndian32(t, pvd[156+2:156+10]); got != isoPrimaryRoot {
+			t.Fatalf("root directory at %d", got)
+		}
+		if got := string(pvd[813:830]); got != "2024010203040500\x00" {
+			t.Fatalf("creation date is %q", got)
+		}
+	})
+
+	t.Run("joliet volume descriptor", func(t *testing.T) {
+		svd := sector(image, 17)
+		if svd[0] != 2 || string(svd[1:6]) != "CD001" {
+			t.Fatalf("bad descriptor header % x", svd[0:7])
+		}
+		if got := string(svd[88:91]); got != "%/E" {
+			t.Fatalf("escape sequence is %q", got)
+		}
+		if !bytes.HasPrefix(svd[40:72], ucs2("cidata")) {
+			t.Fatalf("volume id is % x", svd[40:72])
+		}
+		if got := binary.LittleEndian.Uint32(svd[140:144]); got != isoJolietPathTableL {
+			t.Fatalf("L path table at %d", got)
+		}
+		if got := binary.BigEndian.Uint32(svd[148:152]); got != isoJolietPathTableM {
+			t.Fatalf("M path table at %d", got)
+		}
+		if got := bothEndian32(t, svd[156+2:156+10]); got != isoJolietRoot {
+			t.Fatalf("root directory at %d", got)
+		}
+	})
+
+	t.Run("terminator", func(t *testing.T) {
+		term := sector(image, 18)
+		if term[0] != 255 || string(term[1:6]) != "CD001" {
+			t.Fatalf("bad terminator % x", term[0:7])
+		}
+	})
+
+	t.Run("path tables", func(t *testing.T) {
+		tables := []struct {
+			sector int
+			order  binary.ByteOrder
+			root   uint32
+		}{
+			{isoPrimaryPathTableL, binary.LittleEndian, isoPrimaryRoot},
+			{isoPrimaryPathTableM, binary.BigEndian, isoPrimaryRoot},
+			{isoJolietPathTableL, binary.LittleEndian, isoJolietRoot},
+			{isoJolietPathTableM, binary.BigEndian, isoJolietRoot},
+		}
+
+		for _, table := range tables {
+			entry := sector(image, table.sector)
+			if entry[0] != 1 {
+				t.Fatalf("path table %d name length is %d", table.sector, entry[0])
+			}
+			if got := table.order.Uint32(entry[2:6]); got != table.root {
+				t.Fatalf("path table %d points at %d, want %d", table.sector, got, table.root)
+			}
+			if got := table.order.Uint16(entry[6:8]); got != 1 {
+				t.Fatalf("path table %d parent is %d", table.sector, got)
+			}
+		}
+	})
+
+	directories := []struct {
+		name   string
+		sector int
+		names  [][]byte
+	}{
+		{"primary directory", isoPrimaryRoot, [][]byte{[]byte("META_DATA.;1"), []byte("USER_DATA.;1")}},
+		{"joliet directory", isoJolietRoot, [][]byte{ucs2("meta-data"), ucs2("user-data")}},
+	}
+
+	for _, directory := range directories {
+		t.Run(directory.name, func(t *testing.T) {
+			records := sector(image, directory.sector)
+			offset := 0
+
+			// . and .. point at the root itself
+			for _, name := range []byte{0, 1} {
+				record := records[offset : offset+int(records[offset])]
+				if record[32] != 1 || record[33] != name || record[25] != 2 {
+					t.Fatalf("record %d is not the directory entry %d", offset, name)
+				}
+				if got := bothEndian32(t, record[2:10]); got != uint32(directory.sector) {
+					t.Fatalf("directory entry %d points at %d", name, got)
+				}
+				offset += len(record)
+			}
+
+			// files are sorted by name, meta-data first
+			sortedFiles := []ISOFile{testSeedFiles[1], testSeedFiles[0]}
+			for i, file := range sortedFiles {
+				record := records[offset : offset+int(records[offset])]
+				name := record[33 : 33+int(record[32])]
+				if !bytes.Equal(name, directory.names[i]) {
+					t.Fatalf("record %d is named %q, want %q", i, name, directory.names[i])
+				}
+				if record[25] != 0 {
+					t.Fatalf("%s has flags %d", file.Name, record[25])
+				}
+
+				extent := bothEndian32(t, record[2:10])
+				if want := uint32(isoFirstFile + i); extent != want {
+					t.Fatalf("%s at sector %d, want %d", file.Name, extent, want)
+				}
+				if got := bothEndian32(t, record[10:18]); got != uint32(len(file.Data)) {
+					t.Fatalf("%s is %d bytes, want %d", file.Name, got, len(file.Data))
+				}
+				if got := record[18:24]; !bytes.Equal(got, []byte{124, 1, 2, 3, 4, 5}) {
+					t.Fatalf("%s recorded % x", file.Name, got)
+				}
+
+				data := sector(image, int(extent))
+				if !bytes.Equal(data[:len(file.Data)], file.Data) || !bytes.Equal(data[len(file.Data):], make([]byte, isoSectorSize-len(file.Data))) {
+					t.Fatalf("%s data at sector %d is wrong", file.Name, extent)
+				}
+				offset += len(record)
+			}
+
+			if records[offset] != 0 {
+				t.Fatalf("unexpected record after the files")
+			}
+		})
+	}
+}
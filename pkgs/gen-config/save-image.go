@@ -0,0 +1,91 @@
+package genconfig
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// libvirt qemu save image header, see src/qemu/qemu_saveimage.h
+const saveImageMagic = "LibvirtQemudSave"
+
+type saveImageHeader struct {
+	Magic        [16]byte
+	Version      uint32
+	DataLen      uint32
+	WasRunning   uint32
+	Compressed   uint32
+	CookieOffset uint32
+	Unused       [14]uint32
+}
+
+// CloneSaveImage copies the libvirt memory state file src to dst and
+// rewrites the domain XML embedded in the copy. Every replacement must keep
+// the length of the XML unchanged, so the memory stream that follows the
+// header stays at the same offset.
+func CloneSaveImage(src string, dst string, replacements map[string]string) error {
+
+	log.Println("Cloning save image: ", dst)
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	var header saveImageHeader
+	if err := binary.Read(srcFile, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	if string(header.Magic[:]) != saveImageMagic {
+		return fmt.Errorf("%s is not a complete libvirt save image", src)
+	}
+
+	data := make([]byte, header.DataLen)
+	if _, err := io.ReadFull(srcFile, data); err != nil {
+		return err
+	}
+
+	xmlLen := bytes.IndexByte(data, 0)
+	if header.CookieOffset != 0 && int(header.CookieOffset) < xmlLen {
+		xmlLen = int(header.CookieOffset)
+	}
+	if xmlLen < 0 {
+		return fmt.Errorf("%s has no domain XML", src)
+	}
+
+	domainXML := string(data[:xmlLen])
+	for oldValue, newValue := range replacements {
+		if len(oldValue) != len(newValue) {
+			return fmt.Errorf("replacement %s -> %s changes the XML length", oldValue, newValue)
+		}
+		domainXML = strings.ReplaceAll(domainXML, oldValue, newValue)
+	}
+	copy(data, domainXML)
+
+	outFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	if err := binary.Write(outFile, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	if _, err := outFile.Write(data); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(outFile, srcFile); err != nil {
+		return err
+	}
+
+	log.Println("Cloned save image: ", dst)
+	return nil
+}
@@ -0,0 +1,255 @@
+package genconfig
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// StoragePoolFromEnv is the pool overlays are created in unless a group
+// names another one.
+func StoragePoolFromEnv() string {
+	return helper.GetEnv("STORAGE_POOL_NAME", "default")
+}
+
+// OverlayVolume is the disk of an instance in a storage pool, the domain
+// refers to it by pool and volume name so that libvirt resolves the path,
+// a file in a directory pool or a logical volume in an LVM pool.
+type OverlayVolume struct {
+	Pool string
+	Name string
+	// Format is the driver type of the disk, qcow2 or raw
+	Format string
+}
+
+func OverlayVolumeName(id string) string {
+	return "overlay-" + id + ".qcow2"
+}
+
+// SeedVolumeName is the volume holding the NoCloud seed image of instance
+// id, see GenSeedVolume.
+func SeedVolumeName(id string) string {
+	return "cdrom-" + id + ".iso"
+}
+
+type storagePoolXML struct {
+	Type string `xml:"type,attr"`
+}
+
+type storageVolumeXML struct {
+	XMLName      xml.Name          `xml:"volume"`
+	Name         string            `xml:"name"`
+	Capacity     volumeCapacityXML `xml:"capacity"`
+	Target       volumeTargetXML   `xml:"target"`
+	BackingStore *volumeTargetXML  `xml:"backingStore"`
+}
+
+type volumeCapacityXML struct {
+	Unit  string `xml:"unit,attr"`
+	Value uint64 `xml:",chardata"`
+}
+
+type volumeTargetXML struct {
+	Path   string           `xml:"path,omitempty"`
+	Format *volumeFormatXML `xml:"format"`
+}
+
+type volumeFormatXML struct {
+	Type string `xml:"type,attr"`
+}
+
+// fileBackedPoolTypes hold volumes as image files, so overlays are qcow2
+// files on top of the backing image. Block pools such as LVM make the
+// overlay a snapshot of the backing volume instead.
+var fileBackedPoolTypes = map[string]bool{
+	"dir":      true,
+	"fs":       true,
+	"netfs":    true,
+	"gluster":  true,
+	"vstorage": true,
+}
+
+// GenOverlayVolume creates the overlay of instance id in poolName on conn,
+// backed by the volume backingVolume of the same pool. The capacity is
+// raised to the one of the backing volume when it is smaller.
+func GenOverlayVolume(conn *libvirt.Connect, poolName string, id string, backingVolume string, capacityMiB uint64) (OverlayVolume, error) {
+	log.Printf("Generating overlay volume %s in pool %s\n", OverlayVolumeName(id), poolName)
+	if conn == nil {
+		return OverlayVolume{}, fmt.Errorf("host is unreachable")
+	}
+
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+	defer pool.Free()
+
+	// images copied into the pool are only seen after a refresh
+	if err := pool.Refresh(0); err != nil {
+		log.Printf("Failed to refresh storage pool %s: %v\n", poolName, err)
+	}
+
+	poolXMLDesc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+
+	var poolDesc storagePoolXML
+	if err := xml.Unmarshal([]byte(poolXMLDesc), &poolDesc); err != nil {
+		return OverlayVolume{}, err
+	}
+
+	backing, err := pool.LookupStorageVolByName(backingVolume)
+	if err != nil {
+		return OverlayVolume{}, fmt.Errorf("no backing volume %s in pool %s: %v", backingVolume, poolName, err)
+	}
+	defer backing.Free()
+
+	backingXMLDesc, err := backing.GetXMLDesc(0)
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+
+	var backingDesc storageVolumeXML
+	if err := xml.Unmarshal([]byte(backingXMLDesc), &backingDesc); err != nil {
+		return OverlayVolume{}, err
+	}
+
+	backingInfo, err := backing.GetInfo()
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+
+	capacity := max(capacityMiB*1024*1024, backingInfo.Capacity)
+	volumeDesc := storageVolumeXML{
+		Name:         OverlayVolumeName(id),
+		Capacity:     volumeCapacityXML{Unit: "bytes", Value: capacity},
+		BackingStore: &volumeTargetXML{Path: backingDesc.Target.Path},
+	}
+
+	overlay := OverlayVolume{Pool: poolName, Name: volumeDesc.Name, Format: "raw"}
+	if fileBackedPoolTypes[poolDesc.Type] {
+		overlay.Format = "qcow2"
+		volumeDesc.Target.Format = &volumeFormatXML{Type: "qcow2"}
+
+		backingFormat := "qcow2"
+		if backingDesc.Target.Format != nil && backingDesc.Target.Format.Type != "" {
+			backingFormat = backingDesc.Target.Format.Type
+		}
+		volumeDesc.BackingStore.Format = &volumeFormatXML{Type: backingFormat}
+	}
+
+	volumeXML, err := xml.Marshal(volumeDesc)
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+
+	volume, err := pool.StorageVolCreateXML(string(volumeXML), 0)
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+	defer volume.Free()
+
+	log.Printf("Generated overlay volume %s in pool %s\n", overlay.Name, poolName)
+	return overlay, nil
+}
+
+// uploadVolume creates the raw volume name in poolName on conn that holds
+// data, the volume is deleted again when the upload fails.
+func uploadVolume(conn *libvirt.Connect, poolName string, name string, data []byte) (OverlayVolume, error) {
+	if conn == nil {
+		return OverlayVolume{}, fmt.Errorf("host is unreachable")
+	}
+
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+	defer pool.Free()
+
+	poolXMLDesc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+
+	var poolDesc storagePoolXML
+	if err := xml.Unmarshal([]byte(poolXMLDesc), &poolDesc); err != nil {
+		return OverlayVolume{}, err
+	}
+
+	volumeDesc := storageVolumeXML{
+		Name:     name,
+		Capacity: volumeCapacityXML{Unit: "bytes", Value: uint64(len(data))},
+	}
+	if fileBackedPoolTypes[poolDesc.Type] {
+		volumeDesc.Target.Format = &volumeFormatXML{Type: "raw"}
+	}
+
+	volumeXML, err := xml.Marshal(volumeDesc)
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+
+	volume, err := pool.StorageVolCreateXML(string(volumeXML), 0)
+	if err != nil {
+		return OverlayVolume{}, err
+	}
+	defer volume.Free()
+
+	if err := sendVolume(conn, volume, data); err != nil {
+		if err := volume.Delete(0); err != nil {
+			log.Printf("Failed to delete volume %s from pool %s: %v\n", name, poolName, err)
+		}
+		return OverlayVolume{}, err
+	}
+
+	return OverlayVolume{Pool: poolName, Name: name, Format: "raw"}, nil
+}
+
+func sendVolume(conn *libvirt.Connect, volume *libvirt.StorageVol, data []byte) error {
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+
+	if err := volume.Upload(stream, 0, uint64(len(data)), 0); err != nil {
+		return err
+	}
+
+	for sent := 0; sent < len(data); {
+		n, err := stream.Send(data[sent:])
+		if err != nil {
+			stream.Abort()
+			return err
+		}
+		sent += n
+	}
+
+	return stream.Finish()
+}
+
+// DeleteVolume removes the volume name from poolName on conn.
+func DeleteVolume(conn *libvirt.Connect, poolName string, name string) error {
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+
+	volume, err := pool.LookupStorageVolByName(name)
+	if err != nil {
+		return err
+	}
+	defer volume.Free()
+
+	if err := volume.Delete(0); err != nil {
+		return err
+	}
+
+	log.Printf("Deleted volume %s from pool %s\n", name, poolName)
+	return nil
+}
@@ -0,0 +1,65 @@
+package helper
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// GetEnv returns the value of key, or fallback when it is not defined.
+func GetEnv(key string, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// GetEnvInt returns the integer value of key, or fallback when it is not
+// defined or cannot be parsed.
+func GetEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("[Env] %s is not a valid integer, use fallback value: %d\n", key, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// GetEnvFloat returns the float value of key, or fallback when it is not
+// defined or cannot be parsed.
+func GetEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("[Env] %s is not a valid number, use fallback value: %v\n", key, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// GetEnvBool returns the boolean value of key, or fallback when it is not
+// defined or cannot be parsed.
+func GetEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("[Env] %s is not a valid boolean, use fallback value: %v\n", key, fallback)
+		return fallback
+	}
+	return parsed
+}
@@ -0,0 +1,61 @@
+package host
+
+import (
+	"fmt"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+)
+
+// AdmissionPolicy decides whether a host has room for one more instance.
+type AdmissionPolicy struct {
+	// CPUOvercommitRatio is how many vCPUs may be allocated per physical CPU
+	CPUOvercommitRatio float64
+	// MemoryOvercommitRatio is how much memory may be allocated per MiB of
+	// physical memory left after the host reserve
+	MemoryOvercommitRatio float64
+	// HostMemoryReserveMiB is memory kept for the host itself, it is never
+	// allocated to instances
+	HostMemoryReserveMiB uint64
+}
+
+func AdmissionPolicyFromEnv() AdmissionPolicy {
+	return AdmissionPolicy{
+		CPUOvercommitRatio:    helper.GetEnvFloat("CPU_OVERCOMMIT_RATIO", 4.0),
+		MemoryOvercommitRatio: helper.GetEnvFloat("MEMORY_OVERCOMMIT_RATIO", 1.0),
+		HostMemoryReserveMiB:  uint64(helper.GetEnvInt("HOST_MEMORY_RESERVE_MB", 1024)),
+	}
+}
+
+// Admit returns why capacity cannot take req on top of what is already
+// reserved, or nil when it fits.
+func (p AdmissionPolicy) Admit(capacity *Capacity, reserved Request, req Request) error {
+
+	allowedVcpus := uint(float64(capacity.CPUs) * p.CPUOvercommitRatio)
+	if capacity.AllocatedVcpus+reserved.Vcpus+req.Vcpus > allowedVcpus {
+		return fmt.Errorf("%d vCPU requested, %d of %d vCPU allowed under overcommit ratio %.1f are in use",
+			req.Vcpus, capacity.AllocatedVcpus+reserved.Vcpus, allowedVcpus, p.CPUOvercommitRatio)
+	}
+
+	totalMemoryMiB := capacity.TotalMemoryKiB / 1024
+	allowedMemoryMiB := uint64(float64(totalMemoryMiB-min(totalMemoryMiB, p.HostMemoryReserveMiB)) * p.MemoryOvercommitRatio)
+	allocatedMemoryMiB := capacity.AllocatedMemoryKiB/1024 + reserved.MemoryMiB
+	if allocatedMemoryMiB+req.MemoryMiB > allowedMemoryMiB {
+		return fmt.Errorf("%d MiB memory requested, %d of %d MiB allowed under overcommit ratio %.1f are in use, %d MiB by %d suspended instances",
+			req.MemoryMiB, allocatedMemoryMiB, allowedMemoryMiB, p.MemoryOvercommitRatio, capacity.SuspendedMemoryKiB/1024, capacity.SuspendedInstances)
+	}
+
+	// guests touch their memory lazily, so also refuse hosts that are already
+	// eating into the memory kept for the host itself
+	freeMemoryMiB := capacity.FreeMemoryKiB / 1024
+	if freeMemoryMiB < p.HostMemoryReserveMiB {
+		return fmt.Errorf("only %d MiB memory is physically free, below the %d MiB reserved for the host",
+			freeMemoryMiB, p.HostMemoryReserveMiB)
+	}
+
+	if capacity.DiskKnown && capacity.AvailableDiskMiB < reserved.DiskMiB+req.DiskMiB {
+		return fmt.Errorf("%d MiB disk requested, only %d MiB is free in pool %s",
+			req.DiskMiB, capacity.AvailableDiskMiB-min(capacity.AvailableDiskMiB, reserved.DiskMiB), req.StoragePool)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package host
+
+import (
+	"log"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	"libvirt.org/go/libvirt"
+)
+
+// open connects to the hypervisor with keepalive enabled, so that a dead
+// libvirtd is noticed and reported through the close callback.
+func (h *Host) open() error {
+	conn, err := libvirt.NewConnect(h.URI)
+	if err != nil {
+		return err
+	}
+
+	interval := helper.GetEnvInt("LIBVIRT_KEEPALIVE_INTERVAL_SEC", 5)
+	count := helper.GetEnvInt("LIBVIRT_KEEPALIVE_COUNT", 3)
+	if err := conn.SetKeepAlive(interval, uint(count)); err != nil {
+		log.Printf("[Host] Failed to enable keepalive on %s: %v\n", h.URI, err)
+	}
+
+	if err := conn.RegisterCloseCallback(h.onClose); err != nil {
+		log.Printf("[Host] Failed to register close callback on %s: %v\n", h.URI, err)
+	}
+
+	// without events the instances fall back to polling their state
+	if err := h.watchDomains(conn); err != nil {
+		log.Printf("[Host] Failed to watch domain events on %s: %v\n", h.URI, err)
+	}
+
+	h.mu.Lock()
+	h.conn = conn
+	h.mu.Unlock()
+
+	log.Printf("[Host] Connected to %s\n", h.URI)
+	return nil
+}
+
+func (h *Host) onClose(conn *libvirt.Connect, reason libvirt.ConnectCloseReason) {
+	h.mu.Lock()
+	if h.closing || h.conn == nil {
+		h.mu.Unlock()
+		return
+	}
+	h.conn = nil
+	h.mu.Unlock()
+
+	log.Printf("[Host] Lost connection to %s, reason %d\n", h.URI, reason)
+	conn.UnregisterCloseCallback()
+	conn.Close()
+
+	// the event loop must not block
+	go h.reconnect()
+}
+
+// reconnect retries with exponential backoff until the hypervisor is back,
+// then lets the instances refresh their domain handles.
+func (h *Host) reconnect() {
+	backoff := time.Second
+	maxBackoff := time.Duration(helper.GetEnvInt("LIBVIRT_RECONNECT_MAX_BACKOFF_SEC", 60)) * time.Second
+
+	for {
+		h.mu.Lock()
+		closing := h.closing
+		h.mu.Unlock()
+		if closing {
+			return
+		}
+
+		log.Printf("[Host] Reconnecting to %s in %v\n", h.URI, backoff)
+		time.Sleep(backoff)
+
+		err := h.open()
+		if err == nil {
+			break
+		}
+
+		log.Printf("[Host] Failed to reconnect to %s: %v\n", h.URI, err)
+		backoff = min(backoff*2, maxBackoff)
+	}
+
+	h.mu.Lock()
+	callbacks := append([]func(){}, h.onReconnect...)
+	h.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn()
+	}
+}
+
+// IsConnected reports whether the hypervisor is reachable.
+func (h *Host) IsConnected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.conn != nil
+}
+
+// OnReconnect calls fn after the connection was re-established, domain
+// handles of the old connection are stale by then.
+func (h *Host) OnReconnect(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onReconnect = append(h.onReconnect, fn)
+}
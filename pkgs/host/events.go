@@ -0,0 +1,156 @@
+package host
+
+import (
+	"log"
+	"sync"
+
+	"libvirt.org/go/libvirt"
+)
+
+var eventLoopOnce sync.Once
+
+// startEventLoop runs the libvirt default event loop, it has to be
+// registered before the first connection is opened.
+func startEventLoop() {
+	eventLoopOnce.Do(func() {
+		if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+			log.Printf("[Host] Failed to register event loop, domain events are disabled: %v\n", err)
+			return
+		}
+
+		go func() {
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					log.Printf("[Host] Event loop error: %v\n", err)
+				}
+			}
+		}()
+	})
+}
+
+// DomainEvent is a lifecycle change of a domain on a host, made by the
+// autoscaler or by anyone else, e.g. virsh destroy.
+type DomainEvent struct {
+	Host   string
+	Name   string
+	Event  libvirt.DomainEventType
+	Detail int
+	// State is the domain state after the event, Undefined domains have
+	// no state
+	State     libvirt.DomainState
+	Undefined bool
+}
+
+// Crashed reports whether the guest crashed or its emulator failed.
+func (e DomainEvent) Crashed() bool {
+	switch e.Event {
+	case libvirt.DOMAIN_EVENT_CRASHED:
+		return true
+	case libvirt.DOMAIN_EVENT_STOPPED:
+		detail := libvirt.DomainEventStoppedDetailType(e.Detail)
+		return detail == libvirt.DOMAIN_EVENT_STOPPED_CRASHED || detail == libvirt.DOMAIN_EVENT_STOPPED_FAILED
+	}
+	return false
+}
+
+// Subscribe calls fn for every lifecycle event of the host, from the event
+// loop goroutine so fn must not block.
+func (h *Host) Subscribe(fn func(DomainEvent)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers = append(h.subscribers, fn)
+}
+
+// DomainState returns the event-updated state of the named domain, ok is
+// false when the domain is not known to the cache yet.
+func (h *Host) DomainState(name string) (libvirt.DomainState, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.states[name]
+	return state, ok
+}
+
+// watchDomains seeds the state cache from conn and keeps it updated from
+// lifecycle events.
+func (h *Host) watchDomains(conn *libvirt.Connect) error {
+	if _, err := conn.DomainEventLifecycleRegister(nil, h.onLifecycleEvent); err != nil {
+		return err
+	}
+
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return err
+	}
+
+	states := make(map[string]libvirt.DomainState)
+	for _, domain := range domains {
+		name, nameErr := domain.GetName()
+		state, _, stateErr := domain.GetState()
+		if nameErr == nil && stateErr == nil {
+			states[name] = state
+		}
+		domain.Free()
+	}
+
+	// the previous cache is kept while the host is unreachable, so the
+	// instances keep their last known state
+	h.mu.Lock()
+	h.states = states
+	h.mu.Unlock()
+
+	return nil
+}
+
+func (h *Host) onLifecycleEvent(c *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+	name, err := d.GetName()
+	if err != nil {
+		log.Printf("[Host] Failed to get name of event domain: %v\n", err)
+		return
+	}
+
+	domainEvent := DomainEvent{
+		Host:   h.URI,
+		Name:   name,
+		Event:  event.Event,
+		Detail: event.Detail,
+	}
+
+	h.mu.Lock()
+	state, known := h.states[name]
+	switch event.Event {
+	case libvirt.DOMAIN_EVENT_DEFINED:
+		if !known {
+			state = libvirt.DOMAIN_SHUTOFF
+		}
+	case libvirt.DOMAIN_EVENT_STARTED, libvirt.DOMAIN_EVENT_RESUMED:
+		state = libvirt.DOMAIN_RUNNING
+	case libvirt.DOMAIN_EVENT_SUSPENDED:
+		state = libvirt.DOMAIN_PAUSED
+	case libvirt.DOMAIN_EVENT_PMSUSPENDED:
+		state = libvirt.DOMAIN_PMSUSPENDED
+	case libvirt.DOMAIN_EVENT_SHUTDOWN:
+		// the guest finished shutting down, STOPPED follows
+		state = libvirt.DOMAIN_SHUTDOWN
+	case libvirt.DOMAIN_EVENT_STOPPED:
+		state = libvirt.DOMAIN_SHUTOFF
+		if domainEvent.Crashed() {
+			state = libvirt.DOMAIN_CRASHED
+		}
+	case libvirt.DOMAIN_EVENT_CRASHED:
+		state = libvirt.DOMAIN_CRASHED
+	}
+
+	if event.Event == libvirt.DOMAIN_EVENT_UNDEFINED {
+		delete(h.states, name)
+		domainEvent.Undefined = true
+	} else {
+		h.states[name] = state
+		domainEvent.State = state
+	}
+	subscribers := append([]func(DomainEvent){}, h.subscribers...)
+	h.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(domainEvent)
+	}
+}
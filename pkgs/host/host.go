@@ -0,0 +1,180 @@
+package host
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+
+	"libvirt.org/go/libvirt"
+)
+
+// Host is a hypervisor the autoscaler can place instances on.
+type Host struct {
+	URI  string
+	conn *libvirt.Connect
+
+	mu          sync.Mutex
+	closing     bool
+	states      map[string]libvirt.DomainState
+	subscribers []func(DomainEvent)
+	onReconnect []func()
+}
+
+type Capacity struct {
+	CPUs               uint
+	TotalMemoryKiB     uint64
+	FreeMemoryKiB      uint64
+	AllocatedVcpus     uint
+	AllocatedMemoryKiB uint64
+	Instances          int
+	// suspended domains keep their memory and are part of the allocation,
+	// managed-saved domains are inactive and hold disk only
+	SuspendedInstances int
+	SuspendedMemoryKiB uint64
+	// DiskKnown is false when the storage pool is not found
+	DiskKnown        bool
+	AvailableDiskMiB uint64
+}
+
+// headroom is the smaller of the unallocated memory and vCPU fractions of
+// the host after reserved placements, used to rank hosts for placement.
+func (c *Capacity) headroom(reserved Request) float64 {
+	if c.TotalMemoryKiB == 0 || c.CPUs == 0 {
+		return 0
+	}
+
+	allocatedKiB := float64(c.AllocatedMemoryKiB + reserved.MemoryMiB*1024)
+	memoryHeadroom := (float64(c.TotalMemoryKiB) - allocatedKiB) / float64(c.TotalMemoryKiB)
+	// negative once vCPUs are overcommitted, so busier hosts still rank lower
+	cpuHeadroom := (float64(c.CPUs) - float64(c.AllocatedVcpus+reserved.Vcpus)) / float64(c.CPUs)
+
+	return min(memoryHeadroom, cpuHeadroom)
+}
+
+// Connect opens the connection to the hypervisor at uri. A host that cannot
+// be reached yet is returned disconnected and keeps reconnecting in the
+// background, the error is only informational.
+func Connect(uri string) (*Host, error) {
+	startEventLoop()
+
+	h := &Host{
+		URI:    uri,
+		states: make(map[string]libvirt.DomainState),
+	}
+
+	if err := h.open(); err != nil {
+		go h.reconnect()
+		return h, err
+	}
+
+	return h, nil
+}
+
+// Conn returns the current connection, it is nil while the host is
+// unreachable.
+func (h *Host) Conn() *libvirt.Connect {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.conn
+}
+
+// IsLocal reports whether the hypervisor runs on this machine, so that files
+// it writes can be read here.
+func (h *Host) IsLocal() bool {
+	u, err := url.Parse(h.URI)
+	if err != nil {
+		return false
+	}
+
+	switch u.Hostname() {
+	case "", "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// Capacity reports the physical resources of the host, what the active
+// domains on it are allocated and the free space of storagePool. Paused
+// domains are active and keep their memory.
+func (h *Host) Capacity(storagePool string) (*Capacity, error) {
+	conn := h.Conn()
+	if conn == nil {
+		return nil, fmt.Errorf("host is unreachable")
+	}
+
+	nodeInfo, err := conn.GetNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	freeMemory, err := conn.GetFreeMemory()
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := &Capacity{
+		CPUs:           nodeInfo.Cpus,
+		TotalMemoryKiB: nodeInfo.Memory,
+		FreeMemoryKiB:  freeMemory / 1024,
+	}
+
+	domains, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, domain := range domains {
+		info, err := domain.GetInfo()
+		if err == nil {
+			capacity.AllocatedVcpus += info.NrVirtCpu
+			capacity.AllocatedMemoryKiB += info.MaxMem
+			capacity.Instances++
+
+			if info.State == libvirt.DOMAIN_PAUSED || info.State == libvirt.DOMAIN_PMSUSPENDED {
+				capacity.SuspendedInstances++
+				capacity.SuspendedMemoryKiB += info.MaxMem
+			}
+		}
+		domain.Free()
+	}
+
+	if storagePool == "" {
+		return capacity, nil
+	}
+
+	pool, err := conn.LookupStoragePoolByName(storagePool)
+	if err != nil {
+		log.Printf("[Host] No storage pool %s on %s, skip disk check\n", storagePool, h.URI)
+		return capacity, nil
+	}
+	defer pool.Free()
+
+	if err := pool.Refresh(0); err != nil {
+		log.Printf("[Host] Failed to refresh storage pool on %s: %v\n", h.URI, err)
+	}
+
+	poolInfo, err := pool.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	capacity.DiskKnown = true
+	capacity.AvailableDiskMiB = poolInfo.Available / 1024 / 1024
+
+	return capacity, nil
+}
+
+func (h *Host) Close() {
+	log.Printf("[Host] Closing connection %s\n", h.URI)
+
+	h.mu.Lock()
+	h.closing = true
+	conn := h.conn
+	h.conn = nil
+	h.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,186 @@
+package host
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+type PlacementStrategy string
+
+const (
+	// spread places new instances on the host with the most headroom
+	PLACEMENT_STRATEGY_SPREAD PlacementStrategy = "spread"
+	// binpack fills the busiest host that still fits before using another
+	PLACEMENT_STRATEGY_BINPACK PlacementStrategy = "binpack"
+)
+
+// Request is what a new instance needs from its host.
+type Request struct {
+	MemoryMiB uint64
+	Vcpus     uint
+	DiskMiB   uint64
+	// StoragePool is where DiskMiB is taken from
+	StoragePool string
+}
+
+// Scheduler picks the host for a new instance. Placements that have not been
+// booted yet are held as reservations so that concurrent launches see each
+// other.
+type Scheduler struct {
+	sync.Mutex
+	hosts     []*Host
+	strategy  PlacementStrategy
+	admission AdmissionPolicy
+	reserved  map[string]Request
+}
+
+func NewScheduler(hosts []*Host, strategy PlacementStrategy, admission AdmissionPolicy) *Scheduler {
+	switch strategy {
+	case PLACEMENT_STRATEGY_SPREAD, PLACEMENT_STRATEGY_BINPACK:
+	default:
+		log.Printf("[Scheduler] Unknown placement strategy %s, use fallback value: %s\n", strategy, PLACEMENT_STRATEGY_SPREAD)
+		strategy = PLACEMENT_STRATEGY_SPREAD
+	}
+
+	return &Scheduler{
+		hosts:     hosts,
+		strategy:  strategy,
+		admission: admission,
+		reserved:  make(map[string]Request),
+	}
+}
+
+func (s *Scheduler) Strategy() PlacementStrategy {
+	return s.strategy
+}
+
+func (s *Scheduler) Hosts() []*Host {
+	return s.hosts
+}
+
+// Connected reports whether any host is reachable.
+func (s *Scheduler) Connected() bool {
+	for _, h := range s.hosts {
+		if h.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scheduler) Host(uri string) *Host {
+	for _, h := range s.hosts {
+		if h.URI == uri {
+			return h
+		}
+	}
+	return nil
+}
+
+// Place reserves room for an instance on a host chosen by the strategy, the
+// reservation is held until Done is called. The error lists why each host
+// refused the instance.
+func (s *Scheduler) Place(req Request) (*Host, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	selected, err := s.selectHost(req, func(h *Host) (*Capacity, error) {
+		return h.Capacity(req.StoragePool)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.reserve(selected, req)
+	log.Printf("[Scheduler] Placed %d MiB/%d vCPU on %s (%s)\n", req.MemoryMiB, req.Vcpus, selected.URI, s.strategy)
+	return selected, nil
+}
+
+// selectHost picks the host for req by the strategy among those that admit
+// it, given their capacity. s must be locked.
+func (s *Scheduler) selectHost(req Request, capacityOf func(h *Host) (*Capacity, error)) (*Host, error) {
+	var selected *Host
+	var selectedHeadroom float64
+	reasons := []string{}
+
+	for _, h := range s.hosts {
+		capacity, err := capacityOf(h)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", h.URI, err))
+			continue
+		}
+
+		reserved := s.reserved[h.URI]
+		if err := s.admission.Admit(capacity, reserved, req); err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", h.URI, err))
+			continue
+		}
+
+		headroom := capacity.headroom(reserved)
+
+		better := selected == nil
+		if s.strategy == PLACEMENT_STRATEGY_BINPACK {
+			better = better || headroom < selectedHeadroom
+		} else {
+			better = better || headroom > selectedHeadroom
+		}
+
+		if better {
+			selected = h
+			selectedHeadroom = headroom
+		}
+	}
+
+	if selected == nil {
+		return nil, fmt.Errorf("no host can fit %d MiB/%d vCPU/%d MiB disk: %s", req.MemoryMiB, req.Vcpus, req.DiskMiB, strings.Join(reasons, "; "))
+	}
+	return selected, nil
+}
+
+// Reserve runs the admission check for an instance that must start on h,
+// such as a parked instance, and reserves room on success.
+func (s *Scheduler) Reserve(h *Host, req Request) error {
+	s.Lock()
+	defer s.Unlock()
+
+	capacity, err := h.Capacity(req.StoragePool)
+	if err != nil {
+		return err
+	}
+
+	if err := s.admission.Admit(capacity, s.reserved[h.URI], req); err != nil {
+		return fmt.Errorf("%s: %v", h.URI, err)
+	}
+
+	s.reserve(h, req)
+	return nil
+}
+
+func (s *Scheduler) reserve(h *Host, req Request) {
+	reserved := s.reserved[h.URI]
+	reserved.MemoryMiB += req.MemoryMiB
+	reserved.Vcpus += req.Vcpus
+	reserved.DiskMiB += req.DiskMiB
+	s.reserved[h.URI] = reserved
+}
+
+// Done releases the reservation made by Place or Reserve once the domain is
+// active and counted in the host allocation, or failed to start.
+func (s *Scheduler) Done(h *Host, req Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	reserved := s.reserved[h.URI]
+	reserved.MemoryMiB -= min(reserved.MemoryMiB, req.MemoryMiB)
+	reserved.Vcpus -= min(reserved.Vcpus, req.Vcpus)
+	reserved.DiskMiB -= min(reserved.DiskMiB, req.DiskMiB)
+	s.reserved[h.URI] = reserved
+}
+
+func (s *Scheduler) Close() {
+	for _, h := range s.hosts {
+		h.Close()
+	}
+}
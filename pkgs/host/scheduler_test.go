@@ -0,0 +1,265 @@
+package host
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var testAdmission = AdmissionPolicy{
+	CPUOvercommitRatio:    1,
+	MemoryOvercommitRatio: 1,
+}
+
+// testFleet is a set of disconnected hosts with made up capacities, from a
+// small half used host to a large mostly free one.
+type testFleet struct {
+	small, large, busy *Host
+	capacities         map[*Host]*Capacity
+}
+
+func newTestFleet() *testFleet {
+	fleet := &testFleet{
+		small: &Host{URI: "test:///small"},
+		large: &Host{URI: "test:///large"},
+		busy:  &Host{URI: "test:///busy"},
+	}
+
+	fleet.capacities = map[*Host]*Capacity{
+		// headroom 0.5
+		fleet.small: testCapacity(4, 8192, 2, 4096),
+		// headroom 0.75
+		fleet.large: testCapacity(16, 32768, 4, 8192),
+		// headroom 0.25
+		fleet.busy: testCapacity(8, 16384, 6, 12288),
+	}
+	return fleet
+}
+
+func testCapacity(cpus uint, memoryMiB uint64, allocatedVcpus uint, allocatedMemoryMiB uint64) *Capacity {
+	return &Capacity{
+		CPUs:               cpus,
+		TotalMemoryKiB:     memoryMiB * 1024,
+		FreeMemoryKiB:      (memoryMiB - allocatedMemoryMiB) * 1024,
+		AllocatedVcpus:     allocatedVcpus,
+		AllocatedMemoryKiB: allocatedMemoryMiB * 1024,
+	}
+}
+
+func (f *testFleet) hosts() []*Host {
+	return []*Host{f.small, f.large, f.busy}
+}
+
+func (f *testFleet) capacityOf(h *Host) (*Capacity, error) {
+	capacity, ok := f.capacities[h]
+	if !ok {
+		return nil, fmt.Errorf("host is unreachable")
+	}
+	return capacity, nil
+}
+
+// place selects a host for req and reserves room on it, as Place does.
+func (f *testFleet) place(t *testing.T, s *Scheduler, req Request) *Host {
+	t.Helper()
+
+	h, err := s.selectHost(req, f.capacityOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.reserve(h, req)
+	return h
+}
+
+func expectHosts(t *testing.T, got []*Host, want []*Host) {
+	t.Helper()
+
+	uris := func(hosts []*Host) string {
+		names := []string{}
+		for _, h := range hosts {
+			names = append(names, h.URI)
+		}
+		return strings.Join(names, ", ")
+	}
+
+	if uris(got) != uris(want) {
+		t.Fatalf("placed on %s, want %s", uris(got), uris(want))
+	}
+}
+
+func TestHeadroomIsTheScarcerResource(t *testing.T) {
+	capacity := testCapacity(8, 16384, 2, 12288)
+	if got := capacity.headroom(Request{}); got != 0.25 {
+		t.Fatalf("headroom is %v, want the memory headroom 0.25", got)
+	}
+
+	if got := capacity.headroom(Request{Vcpus: 8}); got != -0.25 {
+		t.Fatalf("headroom with reservations is %v, want the overcommitted CPU headroom -0.25", got)
+	}
+}
+
+func TestSpreadPlacesOnTheHostWithTheMostHeadroom(t *testing.T) {
+	fleet := newTestFleet()
+	s := NewScheduler(fleet.hosts(), PLACEMENT_STRATEGY_SPREAD, testAdmission)
+	req := Request{MemoryMiB: 4096, Vcpus: 2}
+
+	// the large host drops to the headroom of the small one after two
+	// placements, the first host in the list wins a tie
+	placed := []*Host{}
+	for i := 0; i < 3; i++ {
+		placed = append(placed, fleet.place(t, s, req))
+	}
+	expectHosts(t, placed, []*Host{fleet.large, fleet.large, fleet.small})
+}
+
+func TestBinpackFillsTheBusiestHostFirst(t *testing.T) {
+	fleet := newTestFleet()
+	s := NewScheduler(fleet.hosts(), PLACEMENT_STRATEGY_BINPACK, testAdmission)
+	req := Request{MemoryMiB: 2048, Vcpus: 1}
+
+	// the busy host has room for two more, then the small host is the
+	// busiest one left
+	placed := []*Host{}
+	for i := 0; i < 4; i++ {
+		placed = append(placed, fleet.place(t, s, req))
+	}
+	expectHosts(t, placed, []*Host{fleet.busy, fleet.busy, fleet.small, fleet.small})
+}
+
+func TestDoneReleasesTheReservation(t *testing.T) {
+	fleet := newTestFleet()
+	s := NewScheduler(fleet.hosts(), PLACEMENT_STRATEGY_SPREAD, testAdmission)
+	req := Request{MemoryMiB: 4096, Vcpus: 2}
+
+	first := fleet.place(t, s, req)
+	s.Done(first, req)
+
+	if reserved := s.reserved[first.URI]; reserved != (Request{}) {
+		t.Fatalf("%s still has %+v reserved", first.URI, reserved)
+	}
+
+	if second := fleet.place(t, s, req); second != first {
+		t.Fatalf("placed on %s after release, want %s again", second.URI, first.URI)
+	}
+}
+
+func TestPlacementSkipsHostsThatRefuse(t *testing.T) {
+	fleet := newTestFleet()
+	unreachable := &Host{URI: "test:///unreachable"}
+	hosts := append([]*Host{unreachable}, fleet.hosts()...)
+
+	// only the large host has 8 free vCPUs
+	s := NewScheduler(hosts, PLACEMENT_STRATEGY_BINPACK, testAdmission)
+	if h := fleet.place(t, s, Request{MemoryMiB: 1024, Vcpus: 8}); h != fleet.large {
+		t.Fatalf("placed on %s, want %s", h.URI, fleet.large.URI)
+	}
+
+	// memory is physically short on the busy host even though it is not
+	// allocated, e.g. to the page cache
+	fleet.capacities[fleet.busy].FreeMemoryKiB = 512 * 1024
+	s = NewScheduler(hosts, PLACEMENT_STRATEGY_BINPACK, AdmissionPolicy{
+		CPUOvercommitRatio:    1,
+		MemoryOvercommitRatio: 1,
+		HostMemoryReserveMiB:  1024,
+	})
+	if h := fleet.place(t, s, Request{MemoryMiB: 1024, Vcpus: 1}); h != fleet.small {
+		t.Fatalf("placed on %s, want %s", h.URI, fleet.small.URI)
+	}
+
+	_, err := s.selectHost(Request{MemoryMiB: 1024, Vcpus: 32}, fleet.capacityOf)
+	if err == nil {
+		t.Fatal("placed an instance no host has vCPUs for")
+	}
+	for _, h := range hosts {
+		if !strings.Contains(err.Error(), h.URI) {
+			t.Fatalf("error does not say why %s refused: %v", h.URI, err)
+		}
+	}
+}
+
+func TestPlaceOnTestDriver(t *testing.T) {
+	h, err := Connect("test:///default")
+	if err != nil {
+		h.Close()
+		t.Skipf("libvirt test driver is unavailable: %v", err)
+	}
+	defer h.Close()
+
+	unreachable := &Host{URI: "test:///unreachable"}
+	s := NewScheduler([]*Host{unreachable, h}, PLACEMENT_STRATEGY_SPREAD, AdmissionPolicy{
+		CPUOvercommitRatio:    100,
+		MemoryOvercommitRatio: 100,
+	})
+
+	req := Request{MemoryMiB: 128, Vcpus: 1}
+	placed, err := s.Place(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if placed != h {
+		t.Fatalf("placed on %s, want %s", placed.URI, h.URI)
+	}
+	if reserved := s.reserved[h.URI]; reserved != req {
+		t.Fatalf("%s has %+v reserved, want %+v", h.URI, reserved, req)
+	}
+
+	s.Done(placed, req)
+	if err := s.Reserve(h, req); err != nil {
+		t.Fatalf("reserve after release: %v", err)
+	}
+
+	if err := s.Reserve(unreachable, req); err == nil {
+		t.Fatal("reserved room on an unreachable host")
+	}
+}
+
+func TestPlaceAndReserveAcrossTestDriverHosts(t *testing.T) {
+	// the connections share the state of the test driver, so the hosts tie
+	// and share their reservations
+	hosts := []*Host{}
+	for i := 0; i < 2; i++ {
+		h, err := Connect("test:///default")
+		if err != nil {
+			h.Close()
+			t.Skipf("libvirt test driver is unavailable: %v", err)
+		}
+		defer h.Close()
+		hosts = append(hosts, h)
+	}
+
+	capacity, err := hosts[0].Capacity("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity.AllocatedVcpus >= capacity.CPUs {
+		t.Skipf("test driver has no free vCPU, %d of %d allocated", capacity.AllocatedVcpus, capacity.CPUs)
+	}
+
+	s := NewScheduler(hosts, PLACEMENT_STRATEGY_SPREAD, AdmissionPolicy{
+		CPUOvercommitRatio:    1,
+		MemoryOvercommitRatio: 100,
+	})
+	req := Request{MemoryMiB: 1, Vcpus: 1}
+
+	// the first host wins every tie until no vCPU is left on either
+	for i := capacity.AllocatedVcpus; i < capacity.CPUs; i++ {
+		placed, err := s.Place(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if placed != hosts[0] {
+			t.Fatalf("placed on the second connection, want the first one on a tie")
+		}
+	}
+
+	if _, err := s.Place(req); err == nil {
+		t.Fatal("placed an instance with all vCPUs reserved")
+	}
+	if err := s.Reserve(hosts[1], req); err == nil {
+		t.Fatal("reserved a vCPU on a host with all vCPUs reserved")
+	}
+
+	s.Done(hosts[0], req)
+	if err := s.Reserve(hosts[1], req); err != nil {
+		t.Fatalf("reserve after release: %v", err)
+	}
+}
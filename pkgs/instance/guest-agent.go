@@ -0,0 +1,215 @@
+package instance
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// GuestAgent talks to the qemu guest agent over the org.qemu.guest_agent.0
+// channel defined in the domain XML.
+type GuestAgent struct {
+	domain *libvirt.Domain
+}
+
+type guestAgentRequest struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+type guestExecResult struct {
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	OutData  string `json:"out-data"`
+	ErrData  string `json:"err-data"`
+}
+
+type GuestExecOutput struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+func NewGuestAgent(domain *libvirt.Domain) *GuestAgent {
+	return &GuestAgent{
+		domain: domain,
+	}
+}
+
+// command runs a guest agent command and decodes its "return" value into
+// result, result may be nil.
+func (g *GuestAgent) command(execute string, arguments any, result any) error {
+	request, err := json.Marshal(guestAgentRequest{
+		Execute:   execute,
+		Arguments: arguments,
+	})
+	if err != nil {
+		return err
+	}
+
+	raw, err := g.domain.QemuAgentCommand(string(request), libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT, 0)
+	if err != nil {
+		return err
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	response := struct {
+		Return json.RawMessage `json:"return"`
+	}{}
+	if err := json.Unmarshal([]byte(raw), &response); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(response.Return, result)
+}
+
+// Exec runs a program in the guest and waits up to timeout for it to exit.
+func (g *GuestAgent) Exec(path string, args []string, timeout time.Duration) (*GuestExecOutput, error) {
+	started := struct {
+		Pid int `json:"pid"`
+	}{}
+
+	err := g.command("guest-exec", map[string]any{
+		"path":           path,
+		"arg":            args,
+		"capture-output": true,
+	}, &started)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var status guestExecResult
+		if err := g.command("guest-exec-status", map[string]int{"pid": started.Pid}, &status); err != nil {
+			return nil, err
+		}
+
+		if status.Exited {
+			stdout, _ := base64.StdEncoding.DecodeString(status.OutData)
+			stderr, _ := base64.StdEncoding.DecodeString(status.ErrData)
+			return &GuestExecOutput{
+				ExitCode: status.ExitCode,
+				Stdout:   string(stdout),
+				Stderr:   string(stderr),
+			}, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return nil, fmt.Errorf("guest-exec %s did not exit in %v", path, timeout)
+}
+
+// Ping reports whether the agent in the guest answers.
+func (g *GuestAgent) Ping() error {
+	return g.command("guest-ping", nil, &struct{}{})
+}
+
+type GuestNetworkInterface struct {
+	Name            string `json:"name"`
+	HardwareAddress string `json:"hardware-address"`
+	IPAddresses     []struct {
+		Type    string `json:"ip-address-type"`
+		Address string `json:"ip-address"`
+		Prefix  int    `json:"prefix"`
+	} `json:"ip-addresses"`
+}
+
+// NetworkInterfaces lists the interfaces as the guest sees them, which also
+// covers static and bridged networks without a libvirt DHCP lease.
+func (g *GuestAgent) NetworkInterfaces() ([]GuestNetworkInterface, error) {
+	var ifaces []GuestNetworkInterface
+	if err := g.command("guest-network-get-interfaces", nil, &ifaces); err != nil {
+		return nil, err
+	}
+	return ifaces, nil
+}
+
+// IPAddresses returns the routable addresses of the guest, IPv4 first.
+func (g *GuestAgent) IPAddresses() ([]string, error) {
+	ifaces, err := g.NetworkInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv4 := []string{}
+	ipv6 := []string{}
+	for _, iface := range ifaces {
+		for _, addr := range iface.IPAddresses {
+			ip := net.ParseIP(addr.Address)
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+
+			if addr.Type == "ipv4" {
+				ipv4 = append(ipv4, addr.Address)
+			} else {
+				ipv6 = append(ipv6, addr.Address)
+			}
+		}
+	}
+
+	return append(ipv4, ipv6...), nil
+}
+
+// ReadFile reads up to maxBytes of a file in the guest.
+func (g *GuestAgent) ReadFile(path string, maxBytes int) ([]byte, error) {
+	var handle int
+	if err := g.command("guest-file-open", map[string]string{"path": path, "mode": "r"}, &handle); err != nil {
+		return nil, err
+	}
+	defer g.command("guest-file-close", map[string]int{"handle": handle}, nil)
+
+	content := []byte{}
+	for len(content) < maxBytes {
+		var chunk struct {
+			Count  int    `json:"count"`
+			BufB64 string `json:"buf-b64"`
+			Eof    bool   `json:"eof"`
+		}
+		count := min(maxBytes-len(content), 64*1024)
+		if err := g.command("guest-file-read", map[string]int{"handle": handle, "count": count}, &chunk); err != nil {
+			return nil, err
+		}
+
+		data, err := base64.StdEncoding.DecodeString(chunk.BufB64)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, data...)
+
+		if chunk.Eof || chunk.Count == 0 {
+			break
+		}
+	}
+
+	return content, nil
+}
+
+// FsFreeze flushes and freezes the guest filesystems, e.g. for a consistent
+// disk snapshot, and returns how many were frozen. FsThaw must follow.
+func (g *GuestAgent) FsFreeze() (int, error) {
+	var frozen int
+	err := g.command("guest-fsfreeze-freeze", nil, &frozen)
+	return frozen, err
+}
+
+func (g *GuestAgent) FsThaw() (int, error) {
+	var thawed int
+	err := g.command("guest-fsfreeze-thaw", nil, &thawed)
+	return thawed, err
+}
+
+// FsFreezeStatus is "thawed" or "frozen".
+func (g *GuestAgent) FsFreezeStatus() (string, error) {
+	var status string
+	err := g.command("guest-fsfreeze-status", nil, &status)
+	return status, err
+}
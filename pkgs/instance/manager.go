@@ -9,7 +9,24 @@ type InstanceManager interface {
 	GetStatus() VMState
 	GetBootTime() time.Time
 	GetID() string
+	GetHost() string
+	GetTemplateVersion() string
+	GetInstanceType() string
+	GetWeight() int
+	GetBackendURL() string
 	Shutdown() error
+	GetTerminationPath() TerminationPath
+	Start() error
+	Stop() error
+	Suspend() error
+	Resume() error
+	ManagedSave() error
+	IsScaleInProtected() bool
+	GetTags() map[string]string
+	SetTag(key string, value string) error
+	GetSize() (InstanceSize, error)
+	Resize(vcpus uint, memoryMiB uint64) error
+	SetScaleInProtection(bool) error
 	RegisterIP(string, context.Context)
 	DeRegisterIP(string)
 	RegisterPromDiscovery()
@@ -23,4 +40,10 @@ const (
 	VM_STATE_STOPPING
 	VM_STATE_SHUTTING_DOWN
 	VM_STATE_SHUT_OFF
+	VM_STATE_PAUSED
+	VM_STATE_CRASHED
+	// suspended on purpose, e.g. a standby instance, it keeps its memory
+	VM_STATE_SUSPENDED
+	// shut off with a managed save image to resume from
+	VM_STATE_SAVED
 )
@@ -0,0 +1,194 @@
+package instance
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// INSTANCE_METADATA_URI is the namespace of the ownership metadata in the
+// domain XML, readable with:
+//
+//	virsh metadata <domain> https://github.com/linlynnn/kvm-autoscaler/instance
+const INSTANCE_METADATA_URI = "https://github.com/linlynnn/kvm-autoscaler/instance"
+
+// INSTANCE_METADATA_KEY is the namespace prefix libvirt writes the metadata
+// with.
+const INSTANCE_METADATA_KEY = "kas"
+
+// InstanceMetadata makes a domain self-describing, it tells which group and
+// autoscaler own it and what it was built from.
+type InstanceMetadata struct {
+	XMLName xml.Name `xml:"instance"`
+	// Xmlns is only set when the metadata is embedded in a new domain XML,
+	// libvirt adds the namespace itself otherwise
+	Xmlns           string    `xml:"xmlns,attr,omitempty"`
+	Group           string    `xml:"group"`
+	TemplateVersion string    `xml:"templateVersion"`
+	InstanceType    string    `xml:"instanceType"`
+	Weight          int       `xml:"weight"`
+	CreatedAt       time.Time `xml:"createdAt"`
+	AutoscalerID    string    `xml:"autoscalerId"`
+	// GoldenImage is the id of the golden instance whose overlay backs the
+	// disk of a restored instance
+	GoldenImage string `xml:"goldenImage,omitempty"`
+	Tags        []Tag  `xml:"tags>tag"`
+}
+
+type Tag struct {
+	Key   string `xml:"key,attr" json:"key"`
+	Value string `xml:",chardata" json:"value"`
+}
+
+// AutoscalerIDFromEnv identifies this autoscaler among others sharing the
+// hypervisors, it defaults to the hostname.
+func AutoscalerIDFromEnv() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "kvm-autoscaler"
+	}
+	return helper.GetEnv("AUTOSCALER_ID", hostname)
+}
+
+// ParseTags parses a list like "env=prod,team=web".
+func ParseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		key, tagValue, ok := strings.Cut(item, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("tag %q is not key=value", item)
+		}
+		tags[key] = tagValue
+	}
+	return tags, nil
+}
+
+// SetTags replaces the tags with tags, sorted by key.
+func (md *InstanceMetadata) SetTags(tags map[string]string) {
+	md.Tags = []Tag{}
+	for key, value := range tags {
+		md.Tags = append(md.Tags, Tag{Key: key, Value: value})
+	}
+	slices.SortFunc(md.Tags, func(a, b Tag) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+}
+
+func (md InstanceMetadata) TagMap() map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range md.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return tags
+}
+
+// DomainXML returns the metadata as an element of the domain <metadata>.
+func (md InstanceMetadata) DomainXML() (string, error) {
+	md.Xmlns = INSTANCE_METADATA_URI
+	data, err := xml.Marshal(md)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// ReadInstanceMetadata reads the ownership metadata of domain, an error
+// means the domain was not created by an autoscaler.
+func ReadInstanceMetadata(domain *libvirt.Domain) (InstanceMetadata, error) {
+	var md InstanceMetadata
+
+	data, err := domain.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, INSTANCE_METADATA_URI, libvirt.DOMAIN_AFFECT_CURRENT)
+	if err != nil {
+		return md, err
+	}
+
+	if err := xml.Unmarshal([]byte(data), &md); err != nil {
+		return md, err
+	}
+	return md, nil
+}
+
+// AdoptVirtInstanceManager manages a running domain found on a host, e.g.
+// after the autoscaler restarted, from its metadata.
+func AdoptVirtInstanceManager(
+	domain *libvirt.Domain,
+	instanceId string,
+	hostURI string,
+	targetPort string,
+	md InstanceMetadata,
+) *VirtInstanceManager {
+	instanceMng := NewVirtInstanceManager(domain, instanceId, hostURI, targetPort, md.TemplateVersion, md.InstanceType, md.Weight)
+	instanceMng.bootTime = md.CreatedAt
+	return instanceMng
+}
+
+// GetMetadata reads the metadata from the domain on every call, so that
+// changes made with virsh are seen right away.
+func (d *VirtInstanceManager) GetMetadata() (InstanceMetadata, error) {
+	return ReadInstanceMetadata(d.getDomain())
+}
+
+// SetMetadata writes md on the live domain and its persistent config.
+func (d *VirtInstanceManager) SetMetadata(md InstanceMetadata) error {
+	md.Xmlns = ""
+	data, err := xml.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	if state, _, err := d.getDomain().GetState(); err == nil && state != libvirt.DOMAIN_SHUTOFF {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+
+	if err := d.getDomain().SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, string(data), INSTANCE_METADATA_KEY, INSTANCE_METADATA_URI, flags); err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// GetTags returns the user-defined tags of the instance, empty when the
+// domain has no metadata.
+func (d *VirtInstanceManager) GetTags() map[string]string {
+	md, err := d.GetMetadata()
+	if err != nil {
+		return map[string]string{}
+	}
+	return md.TagMap()
+}
+
+// SetTag adds or changes a tag, an empty value removes it.
+func (d *VirtInstanceManager) SetTag(key string, value string) error {
+	md, err := d.GetMetadata()
+	if err != nil {
+		return fmt.Errorf("VM %s has no autoscaler metadata: %v", d.GetID(), err)
+	}
+
+	tags := md.TagMap()
+	if value == "" {
+		delete(tags, key)
+	} else {
+		tags[key] = value
+	}
+	md.SetTags(tags)
+
+	if err := d.SetMetadata(md); err != nil {
+		return err
+	}
+
+	log.Printf("[Metadata] VM %s tag %s=%q\n", d.GetID(), key, value)
+	return nil
+}
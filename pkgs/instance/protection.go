@@ -0,0 +1,57 @@
+package instance
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// PROTECTION_METADATA_URI is the namespace of the scale-in protection label
+// in the domain metadata. It can be set by hand as well:
+//
+//	virsh metadata <domain> https://github.com/linlynnn/kvm-autoscaler/protection \
+//	  --key protection --set '<protection scaleIn="true"/>'
+const PROTECTION_METADATA_URI = "https://github.com/linlynnn/kvm-autoscaler/protection"
+
+// IsScaleInProtected reports whether the domain carries the protection
+// label. The label is read on every call so that changes made with virsh
+// are seen right away. An instance whose label cannot be read counts as
+// protected, so that a libvirt error never removes it by mistake.
+func (d *VirtInstanceManager) IsScaleInProtected() bool {
+	metadata, err := d.getDomain().GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, PROTECTION_METADATA_URI, libvirt.DOMAIN_AFFECT_CURRENT)
+	if err != nil {
+		var libvirtErr libvirt.Error
+		if errors.As(err, &libvirtErr) && libvirtErr.Code == libvirt.ERR_NO_DOMAIN_METADATA {
+			// the domain has no label
+			return false
+		}
+
+		log.Printf("[Protection] Failed to read protection of VM %s, treat it as protected: %v\n", d.GetID(), err)
+		return true
+	}
+	return strings.Contains(metadata, `scaleIn="true"`)
+}
+
+// SetScaleInProtection adds or removes the protection label, on the live
+// domain and its persistent config.
+func (d *VirtInstanceManager) SetScaleInProtection(protected bool) error {
+	metadata := ""
+	if protected {
+		metadata = `<protection scaleIn="true"/>`
+	}
+
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	if state, _, err := d.getDomain().GetState(); err == nil && state != libvirt.DOMAIN_SHUTOFF {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+
+	if err := d.getDomain().SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, metadata, "protection", PROTECTION_METADATA_URI, flags); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	log.Printf("[Protection] VM %s scale-in protection %t\n", d.GetID(), protected)
+	return nil
+}
@@ -0,0 +1,192 @@
+package instance
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+type ReadinessProbeType string
+
+const (
+	// GET on Path of the probe port, 2xx and 3xx are ready
+	READINESS_PROBE_HTTP ReadinessProbeType = "http"
+	// a TCP connect to the probe port
+	READINESS_PROBE_TCP ReadinessProbeType = "tcp"
+	// the node_exporter metrics on port 9100
+	READINESS_PROBE_NODE_EXPORTER ReadinessProbeType = "node_exporter"
+	// Command run through the guest agent exits 0
+	READINESS_PROBE_GUEST_AGENT ReadinessProbeType = "guest-agent"
+)
+
+// ReadinessProbe decides when a booted instance can take traffic.
+type ReadinessProbe struct {
+	Type ReadinessProbeType
+	Path string
+	// Port defaults to the target port of the instance
+	Port     string
+	Command  []string
+	Interval time.Duration
+	// Timeout is the deadline of the whole probing, from IP discovery on
+	Timeout time.Duration
+}
+
+func ReadinessProbeFromEnv() ReadinessProbe {
+	probeType := ReadinessProbeType(helper.GetEnv("READINESS_PROBE_TYPE", string(READINESS_PROBE_HTTP)))
+	switch probeType {
+	case READINESS_PROBE_HTTP, READINESS_PROBE_TCP, READINESS_PROBE_NODE_EXPORTER, READINESS_PROBE_GUEST_AGENT:
+	default:
+		log.Printf("[Readiness] Unknown probe type %s, use fallback value: %s\n", probeType, READINESS_PROBE_HTTP)
+		probeType = READINESS_PROBE_HTTP
+	}
+
+	return ReadinessProbe{
+		Type:     probeType,
+		Path:     helper.GetEnv("READINESS_PROBE_PATH", "/"),
+		Port:     helper.GetEnv("READINESS_PROBE_PORT", ""),
+		Command:  strings.Fields(helper.GetEnv("READINESS_PROBE_COMMAND", "/usr/bin/test -f /var/lib/cloud/instance/boot-finished")),
+		Interval: time.Duration(helper.GetEnvInt("READINESS_PROBE_INTERVAL_SEC", 5)) * time.Second,
+		// the cold start timeout used to be a fixed wait, it is the deadline now
+		Timeout: time.Duration(helper.GetEnvInt("COLD_START_TIMEOUT_MIN", 8)) * time.Minute,
+	}
+}
+
+// WaitUntilReady discovers the IP of the instance and polls the readiness
+// probe from READINESS_PROBE_* until it succeeds, the probe deadline passes
+// or ctx is done.
+func (d *VirtInstanceManager) WaitUntilReady(ctx context.Context) error {
+	probe := ReadinessProbeFromEnv()
+	ctx, cancel := context.WithTimeout(ctx, probe.Timeout)
+	defer cancel()
+
+	ipAddress, err := d.waitForIP(ctx)
+	if err != nil {
+		return err
+	}
+
+	port := probe.Port
+	if port == "" {
+		port = d.targetPort
+	}
+
+	start := time.Now()
+	for {
+		err := d.probe(probe, ipAddress, port)
+		if err == nil {
+			log.Printf("[Readiness] VM %s is ready after %v\n", d.GetID(), time.Since(start).Round(time.Second))
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("VM %s is not ready after %v: %v", d.GetID(), time.Since(start).Round(time.Second), err)
+		case <-time.After(probe.Interval):
+		}
+	}
+}
+
+func (d *VirtInstanceManager) probe(probe ReadinessProbe, ipAddress string, port string) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	switch probe.Type {
+	case READINESS_PROBE_TCP:
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ipAddress, port), 5*time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case READINESS_PROBE_NODE_EXPORTER:
+		return probeHTTP(client, "http://"+net.JoinHostPort(ipAddress, "9100")+"/metrics")
+
+	case READINESS_PROBE_GUEST_AGENT:
+		if len(probe.Command) == 0 {
+			return fmt.Errorf("no readiness command")
+		}
+
+		output, err := d.GuestAgent().Exec(probe.Command[0], probe.Command[1:], 30*time.Second)
+		if err != nil {
+			return err
+		}
+		if output.ExitCode != 0 {
+			return fmt.Errorf("readiness command exited %d", output.ExitCode)
+		}
+		return nil
+	}
+
+	return probeHTTP(client, "http://"+net.JoinHostPort(ipAddress, port)+probe.Path)
+}
+
+func probeHTTP(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// waitForIP polls the DHCP leases until the instance got an address, and
+// asks the guest agent when there is no lease, e.g. on a bridged network.
+func (d *VirtInstanceManager) waitForIP(ctx context.Context) (string, error) {
+	tick := time.NewTicker(2 * time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("no IP found for VM %s", d.GetID())
+
+		case <-tick.C:
+			ipAddress, err := d.leaseIPAddress()
+			if err != nil || ipAddress == "" {
+				if addrs, agentErr := d.GuestAgent().IPAddresses(); agentErr == nil && len(addrs) > 0 {
+					ipAddress = addrs[0]
+				}
+			}
+
+			if ipAddress == "" {
+				continue
+			}
+
+			log.Printf("[Readiness] Found IP for VM %s: %s\n", d.GetID(), ipAddress)
+			d.mu.Lock()
+			d.ipAddress = ipAddress
+			d.mu.Unlock()
+			return ipAddress, nil
+		}
+	}
+}
+
+// leaseIPAddress prefers an IPv4 lease, as the guest agent does.
+func (d *VirtInstanceManager) leaseIPAddress() (string, error) {
+	ifaces, err := d.getDomain().ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+	if err != nil {
+		return "", err
+	}
+
+	ipv6 := ""
+	for _, iface := range ifaces {
+		for _, addr := range iface.Addrs {
+			switch {
+			case addr.Addr == "":
+			case addr.Type == libvirt.IP_ADDR_TYPE_IPV4:
+				return addr.Addr, nil
+			case ipv6 == "":
+				ipv6 = addr.Addr
+			}
+		}
+	}
+	return ipv6, nil
+}
@@ -0,0 +1,70 @@
+package instance
+
+import (
+	"fmt"
+	"log"
+
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// InstanceSize is the current and hot-pluggable maximum size of an
+// instance, the maximums are fixed in the domain XML at boot.
+type InstanceSize struct {
+	Vcpus        uint
+	MemoryMiB    uint64
+	MaxVcpus     uint
+	MaxMemoryMiB uint64
+}
+
+func (d *VirtInstanceManager) GetSize() (InstanceSize, error) {
+	info, err := d.getDomain().GetInfo()
+	if err != nil {
+		return InstanceSize{}, err
+	}
+
+	maxVcpus, err := d.getDomain().GetVcpusFlags(libvirt.DOMAIN_VCPU_MAXIMUM | libvirt.DOMAIN_VCPU_CONFIG)
+	if err != nil {
+		return InstanceSize{}, err
+	}
+
+	return InstanceSize{
+		Vcpus:        info.NrVirtCpu,
+		MemoryMiB:    info.Memory / 1024,
+		MaxVcpus:     uint(maxVcpus),
+		MaxMemoryMiB: info.MaxMem / 1024,
+	}, nil
+}
+
+// Resize hot-plugs vCPUs and balloons memory on the running domain, and
+// keeps the new size in its config so it survives a restart.
+func (d *VirtInstanceManager) Resize(vcpus uint, memoryMiB uint64) error {
+	size, err := d.GetSize()
+	if err != nil {
+		return err
+	}
+
+	if vcpus == 0 || vcpus > size.MaxVcpus {
+		return fmt.Errorf("VM %s can have 1-%d vCPUs, %d requested", d.GetID(), size.MaxVcpus, vcpus)
+	}
+
+	if memoryMiB == 0 || memoryMiB > size.MaxMemoryMiB {
+		return fmt.Errorf("VM %s can have up to %d MiB memory, %d MiB requested", d.GetID(), size.MaxMemoryMiB, memoryMiB)
+	}
+
+	if vcpus != size.Vcpus {
+		if err := d.getDomain().SetVcpusFlags(vcpus, libvirt.DOMAIN_VCPU_LIVE|libvirt.DOMAIN_VCPU_CONFIG); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	if memoryMiB != size.MemoryMiB {
+		if err := d.getDomain().SetMemoryFlags(memoryMiB*1024, libvirt.DOMAIN_MEM_LIVE|libvirt.DOMAIN_MEM_CONFIG); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	log.Printf("[Resize] VM %s resized from %d vCPU/%d MiB to %d vCPU/%d MiB\n", d.GetID(), size.Vcpus, size.MemoryMiB, vcpus, memoryMiB)
+	return nil
+}
@@ -0,0 +1,70 @@
+package instance
+
+import (
+	"log"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+// TerminationPath records how an instance was powered off.
+type TerminationPath string
+
+const (
+	TERMINATION_PATH_NONE TerminationPath = ""
+	// the domain was not running, e.g. a stopped or saved parked instance
+	TERMINATION_PATH_ALREADY_OFF TerminationPath = "already-off"
+	TERMINATION_PATH_ACPI        TerminationPath = "acpi"
+	TERMINATION_PATH_GUEST_AGENT TerminationPath = "guest-agent"
+	// the guest did not shut down in time, or could not be asked to
+	TERMINATION_PATH_DESTROY TerminationPath = "destroy"
+)
+
+// powerOff asks the guest to shut down cleanly, through ACPI or the guest
+// agent depending on SHUTDOWN_METHOD, and waits up to SHUTDOWN_TIMEOUT_SEC
+// for the domain to shut off before escalating to Destroy.
+func (d *VirtInstanceManager) powerOff() (TerminationPath, error) {
+	state, _, err := d.getDomain().GetState()
+	if err != nil {
+		return TERMINATION_PATH_NONE, err
+	}
+
+	switch state {
+	case libvirt.DOMAIN_SHUTOFF:
+		return TERMINATION_PATH_ALREADY_OFF, nil
+	case libvirt.DOMAIN_PAUSED:
+		// a paused guest cannot react to a shutdown request
+		return TERMINATION_PATH_DESTROY, d.getDomain().Destroy()
+	}
+
+	timeout := time.Duration(helper.GetEnvInt("SHUTDOWN_TIMEOUT_SEC", 60)) * time.Second
+
+	path := TERMINATION_PATH_ACPI
+	flags := libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN
+	if helper.GetEnv("SHUTDOWN_METHOD", "acpi") == "guest-agent" {
+		path = TERMINATION_PATH_GUEST_AGENT
+		flags = libvirt.DOMAIN_SHUTDOWN_GUEST_AGENT
+	}
+
+	log.Printf("[PowerOff] Requesting %s shutdown of VM %s, timeout %v\n", path, d.GetID(), timeout)
+	if err := d.getDomain().ShutdownFlags(flags); err != nil {
+		log.Printf("[PowerOff] %s shutdown of VM %s failed: %v\n", path, d.GetID(), err)
+	} else if d.waitForState(libvirt.DOMAIN_SHUTOFF, timeout) {
+		return path, nil
+	} else {
+		log.Printf("[PowerOff] VM %s did not shut off in %v\n", d.GetID(), timeout)
+	}
+
+	log.Printf("[PowerOff] Escalating to destroy VM %s\n", d.GetID())
+	if err := d.getDomain().Destroy(); err != nil {
+		return TERMINATION_PATH_DESTROY, err
+	}
+	return TERMINATION_PATH_DESTROY, nil
+}
+
+func (d *VirtInstanceManager) GetTerminationPath() TerminationPath {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.terminationPath
+}
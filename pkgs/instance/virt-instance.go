@@ -7,9 +7,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"os"
-	"strconv"
+	"sync"
 	"time"
 
 	libvirt "libvirt.org/go/libvirt"
@@ -17,91 +17,128 @@ import (
 
 type VirtInstanceManager struct {
 	// InstanceConn
-	id        string
-	domain    *libvirt.Domain
-	bootTime  time.Time
-	ipAddress string
+	mu              sync.Mutex
+	id              string
+	uuid            string
+	host            string
+	targetPort      string
+	domain          *libvirt.Domain
+	bootTime        time.Time
+	ipAddress       string
+	terminationPath TerminationPath
+	// templateVersion identifies the group template the instance was built
+	// from, instance refresh replaces instances of older versions
+	templateVersion string
+	// instanceType is the catalog type, weight the capacity it counts for
+	// in its group and its share of the load balancer traffic
+	instanceType string
+	weight       int
+	stateSource  StateSource
+	// keepVolumes leaves the overlay in the pool on Shutdown
+	keepVolumes bool
+}
+
+// StateSource is an event-updated view of the domain states on a host.
+type StateSource interface {
+	DomainState(name string) (libvirt.DomainState, bool)
 }
 
 func NewVirtInstanceManager(
 	domain *libvirt.Domain,
 	instanceId string,
+	hostURI string,
+	targetPort string,
+	templateVersion string,
+	instanceType string,
+	weight int,
 ) *VirtInstanceManager {
 	bootTime := time.Now()
 
+	// the uuid finds the domain again after a reconnect
+	uuid, err := domain.GetUUIDString()
+	if err != nil {
+		log.Printf("[VirtInstanceManager] Failed to get uuid of %s: %v\n", instanceId, err)
+	}
+
 	return &VirtInstanceManager{
-		domain:   domain,
-		id:       instanceId,
-		bootTime: bootTime,
+		domain:          domain,
+		uuid:            uuid,
+		id:              instanceId,
+		host:            hostURI,
+		targetPort:      targetPort,
+		bootTime:        bootTime,
+		templateVersion: templateVersion,
+		instanceType:    instanceType,
+		weight:          weight,
 	}
 
 }
 
+func (d *VirtInstanceManager) getDomain() *libvirt.Domain {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.domain
+}
+
+// RefreshDomain looks the domain up by uuid on a new connection, the handle
+// of the previous connection is stale after libvirtd restarted.
+func (d *VirtInstanceManager) RefreshDomain(conn *libvirt.Connect) error {
+	domain, err := conn.LookupDomainByUUIDString(d.uuid)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.domain = domain
+	d.mu.Unlock()
+
+	log.Printf("[VirtInstanceManager] Refreshed domain handle of %s\n", d.GetID())
+	return nil
+}
+
+// GuestAgent returns a client for the agent running in the guest, used for
+// readiness checks and diagnostics.
+func (d *VirtInstanceManager) GuestAgent() *GuestAgent {
+	return NewGuestAgent(d.getDomain())
+}
+
 func (d *VirtInstanceManager) GetID() string {
 	return d.id
 
 }
 
-func (d *VirtInstanceManager) RegisterIP(lbUrl string, ctx context.Context) {
-
-	log.Printf("[RegisterIP] Registering IP for VM %s\n", d.GetID())
-	//timeout := time.After(1 * time.Minute)
-	tick := time.Tick(2 * time.Second)
-	var ipAddress string
+func (d *VirtInstanceManager) GetTemplateVersion() string {
+	return d.templateVersion
+}
 
-OuterLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("[RegisterIP] Timeout: no IP found for VM %s\n", d.GetID())
-			return
-
-		case <-tick:
-			ifaces, err := d.domain.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
-			if err != nil {
-				log.Printf("[RegisterIP] Retrying... failed to get interface addresses: %v", err)
-				continue
-			}
-
-			for _, iface := range ifaces {
-				for _, addr := range iface.Addrs {
-					if addr.Addr != "" {
-						log.Printf("[RegisterIP] Found IP for VM %s: %s\n", d.GetID(), addr.Addr)
-						ipAddress = addr.Addr
-						// TODO: register/store this IP in your system
-
-						break OuterLoop
-					}
-				}
-			}
-		}
-	}
+func (d *VirtInstanceManager) GetInstanceType() string {
+	return d.instanceType
+}
 
-	if ipAddress == "" {
-		return
-	}
+func (d *VirtInstanceManager) GetWeight() int {
+	return d.weight
+}
 
-	d.ipAddress = ipAddress
+func (d *VirtInstanceManager) GetHost() string {
+	return d.host
+}
 
-	coldStartTimeoutEnv := os.Getenv("COLD_START_TIMEOUT_MIN")
-	if coldStartTimeoutEnv == "" {
-		log.Println("[RegisterIP] COLD_START_TIMEOUT_MIN is not defined, use fallback value 8")
-		coldStartTimeoutEnv = "8"
-	}
+// RegisterIP registers the instance with the load balancer once its
+// readiness probe passes.
+func (d *VirtInstanceManager) RegisterIP(lbUrl string, ctx context.Context) {
 
-	coldStartTimeout, err := strconv.Atoi(coldStartTimeoutEnv)
-	if err != nil {
-		log.Println(err)
+	log.Printf("[RegisterIP] Registering IP for VM %s\n", d.GetID())
+	if err := d.WaitUntilReady(ctx); err != nil {
+		log.Printf("[RegisterIP] Skip registering: %v\n", err)
+		return
 	}
 
-	log.Printf("[RegisterIP] Wait for vm %s startup application for %d minute\n", ipAddress, coldStartTimeout)
-	time.Sleep(time.Duration(coldStartTimeout) * time.Minute)
-
 	lbUrl = lbUrl + "/backend"
 
-	payload := map[string]string{
-		"name": d.GetID(),
-		"url":  "http://" + ipAddress + ":" + os.Getenv("TARGET_PORT"),
+	payload := map[string]interface{}{
+		"name":   d.GetID(),
+		"url":    d.GetBackendURL(),
+		"weight": d.GetWeight(),
 	}
 
 	jsonData, err := json.Marshal(payload)
@@ -129,19 +166,57 @@ OuterLoop:
 
 }
 
+// GetBackendURL is the URL the instance is registered with in the load
+// balancer.
+func (d *VirtInstanceManager) GetBackendURL() string {
+	// the guest agent may report an IPv6 address, which needs brackets
+	return "http://" + net.JoinHostPort(d.getIPAddress(), d.targetPort)
+}
+
+func (d *VirtInstanceManager) getIPAddress() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ipAddress
+}
+
 func (d *VirtInstanceManager) GetBootTime() time.Time {
 	return d.bootTime
 }
 
+// GetStatus returns the event-updated state when the instance watches its
+// host and asks libvirt otherwise. Paused and shut off domains are always
+// looked up, the reason tells suspended and saved instances apart.
 func (d *VirtInstanceManager) GetStatus() VMState {
+	if d.stateSource != nil {
+		if state, ok := d.stateSource.DomainState(d.id); ok && state != libvirt.DOMAIN_PAUSED && state != libvirt.DOMAIN_SHUTOFF {
+			return vmStateOf(state)
+		}
+	}
+
 	// Get the VM state
-	state, _, err := d.domain.GetState()
+	state, reason, err := d.getDomain().GetState()
 	if err != nil {
 		log.Printf("Failed to get domain state: %v\n", err)
 		return VM_STATE_SHUT_OFF
 
 	}
 
+	switch state {
+	case libvirt.DOMAIN_PAUSED:
+		if libvirt.DomainPausedReason(reason) == libvirt.DOMAIN_PAUSED_USER {
+			return VM_STATE_SUSPENDED
+		}
+	case libvirt.DOMAIN_SHUTOFF:
+		if hasImage, err := d.getDomain().HasManagedSaveImage(0); err == nil && hasImage {
+			return VM_STATE_SAVED
+		}
+	}
+
+	return vmStateOf(state)
+
+}
+
+func vmStateOf(state libvirt.DomainState) VMState {
 	switch state {
 	case libvirt.DOMAIN_RUNNING:
 		return VM_STATE_RUNNING
@@ -149,17 +224,28 @@ func (d *VirtInstanceManager) GetStatus() VMState {
 		return VM_STATE_SHUTTING_DOWN
 	case libvirt.DOMAIN_SHUTOFF:
 		return VM_STATE_SHUT_OFF
+	case libvirt.DOMAIN_PAUSED:
+		return VM_STATE_PAUSED
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return VM_STATE_SUSPENDED
+	case libvirt.DOMAIN_CRASHED:
+		return VM_STATE_CRASHED
 	}
 
 	return VM_STATE_RUNNING
+}
 
+// WatchState makes GetStatus read the domain state from src instead of
+// calling libvirt for every lookup.
+func (d *VirtInstanceManager) WatchState(src StateSource) {
+	d.stateSource = src
 }
 
 func (d *VirtInstanceManager) DeRegisterIP(lbUrl string) {
 	lbUrl = lbUrl + "/backend"
 
 	payload := map[string]string{
-		"url": "http://" + d.ipAddress + ":" + os.Getenv("TARGET_PORT"),
+		"url": d.GetBackendURL(),
 	}
 
 	jsonData, err := json.Marshal(payload)
@@ -190,43 +276,178 @@ func (d *VirtInstanceManager) Shutdown() error {
 	// virt shutdown implementation
 
 	log.Printf("[Shutdown] Shutting Down VM %s\n", d.GetID())
-	if err := d.domain.Destroy(); err != nil {
+	path, err := d.powerOff()
+
+	d.mu.Lock()
+	d.terminationPath = path
+	d.mu.Unlock()
+
+	if err != nil {
 		log.Println(err)
 		return err
 	}
-	log.Printf("[Shutdown] Shut off VM %s\n", d.GetID())
+	log.Printf("[Shutdown] Shut off VM %s via %s\n", d.GetID(), path)
+
+	// the disks are only known from the definition
+	volumes, err := d.volumes()
+	if err != nil {
+		log.Println(err)
+	}
 
 	log.Printf("[Shutdown] Undefining VM %s\n", d.GetID())
-	if err := d.domain.Undefine(); err != nil {
+	if err := d.getDomain().UndefineFlags(libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE); err != nil {
 		log.Println(err)
 		return err
 	}
 	log.Printf("[Shutdown] Undefined VM %s\n", d.GetID())
 
+	d.mu.Lock()
+	keepVolumes := d.keepVolumes
+	d.mu.Unlock()
+	if !keepVolumes {
+		d.deleteVolumes(volumes)
+	}
+
 	return nil
 
 }
 
-func (d *VirtInstanceManager) RegisterPromDiscovery() {
+// SaveState saves the memory state of the instance to path and stops it.
+func (d *VirtInstanceManager) SaveState(path string) error {
+	log.Printf("[SaveState] Saving VM %s to %s\n", d.GetID(), path)
+	if err := d.getDomain().Save(path); err != nil {
+		log.Println(err)
+		return err
+	}
+	log.Printf("[SaveState] Saved VM %s\n", d.GetID())
+	return nil
+}
 
-	coldStartTimeoutEnv := os.Getenv("COLD_START_TIMEOUT_MIN")
-	if coldStartTimeoutEnv == "" {
-		log.Println("[RegisterPrometheusDiscovery] COLD_START_TIMEOUT_MIN is not defined, use fallback value 8")
-		coldStartTimeoutEnv = "8"
+// Start boots a shut off instance, restoring its managed save image if any.
+func (d *VirtInstanceManager) Start() error {
+	log.Printf("[Start] Starting VM %s\n", d.GetID())
+	if err := d.getDomain().Create(); err != nil {
+		log.Println(err)
+		return err
 	}
+	log.Printf("[Start] Started VM %s\n", d.GetID())
+	return nil
+}
 
-	coldStartTimeout, err := strconv.Atoi(coldStartTimeoutEnv)
+// Stop powers the instance off cleanly but keeps it defined.
+func (d *VirtInstanceManager) Stop() error {
+	log.Printf("[Stop] Stopping VM %s\n", d.GetID())
+	path, err := d.powerOff()
 	if err != nil {
 		log.Println(err)
+		return err
+	}
+
+	log.Printf("[Stop] Stopped VM %s via %s\n", d.GetID(), path)
+	return nil
+}
+
+func (d *VirtInstanceManager) Suspend() error {
+	log.Printf("[Suspend] Suspending VM %s\n", d.GetID())
+	if err := d.getDomain().Suspend(); err != nil {
+		log.Println(err)
+		return err
 	}
+	log.Printf("[Suspend] Suspended VM %s\n", d.GetID())
+	return nil
+}
 
-	log.Printf("[RegisterPrometheusDiscovery] Wait for vm %s startup application for %d minute\n", d.ipAddress, coldStartTimeout)
-	time.Sleep(time.Duration(coldStartTimeout) * time.Minute)
+func (d *VirtInstanceManager) Resume() error {
+	log.Printf("[Resume] Resuming VM %s\n", d.GetID())
+	if err := d.getDomain().Resume(); err != nil {
+		log.Println(err)
+		return err
+	}
+	log.Printf("[Resume] Resumed VM %s\n", d.GetID())
+	return nil
+}
+
+// ManagedSave saves the memory state of the instance and stops it, the next
+// Start restores from the saved state.
+func (d *VirtInstanceManager) ManagedSave() error {
+	log.Printf("[ManagedSave] Saving VM %s\n", d.GetID())
+	if err := d.getDomain().ManagedSave(0); err != nil {
+		log.Println(err)
+		return err
+	}
+	log.Printf("[ManagedSave] Saved VM %s\n", d.GetID())
+	return nil
+}
+
+// identityFixupScript gives an instance restored from the golden memory
+// state its own hostname, machine-id and MAC address, then renews DHCP.
+const identityFixupScript = `hostnamectl set-hostname "$1"
+rm -f /etc/machine-id /var/lib/dbus/machine-id
+systemd-machine-id-setup
+IFACE=$(ip -o route show default | awk '{print $5}' | head -n 1)
+OLD_MAC=$(cat /sys/class/net/$IFACE/address)
+sed -i "s/$OLD_MAC/$2/g" /etc/netplan/*.yaml
+ip link set dev $IFACE address "$2"
+netplan apply
+`
+
+// ApplyIdentity runs the identity fixups through the guest agent after the
+// instance has been restored from a memory state file.
+func (d *VirtInstanceManager) ApplyIdentity(hostname string, macAddress string) error {
+	log.Printf("[ApplyIdentity] Applying identity to VM %s\n", d.GetID())
+
+	agent := d.GuestAgent()
+	deadline := time.Now().Add(1 * time.Minute)
+	for {
+		// the agent needs a moment to reconnect after restore
+		if err := d.getDomain().SetTime(0, 0, libvirt.DOMAIN_TIME_SYNC); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			log.Println(err)
+			return err
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	output, err := agent.Exec("/bin/sh", []string{"-c", identityFixupScript, "fixup", hostname, macAddress}, 2*time.Minute)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if output.ExitCode != 0 {
+		err := fmt.Errorf("identity fixup exited with %d: %s", output.ExitCode, output.Stderr)
+		log.Println(err)
+		return err
+	}
+
+	log.Printf("[ApplyIdentity] Applied identity to VM %s\n", d.GetID())
+	return nil
+}
+
+func (d *VirtInstanceManager) waitForState(target libvirt.DomainState, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		state, _, err := d.getDomain().GetState()
+		if err == nil && state == target {
+			return true
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return false
+}
+
+func (d *VirtInstanceManager) RegisterPromDiscovery() {
+
+	if err := d.WaitUntilReady(context.Background()); err != nil {
+		log.Printf("[RegisterPrometheusDiscovery] Skip registering: %v\n", err)
+		return
+	}
 
 	discoveryUrl := "http://localhost:9093/targets/node_exporter"
 
 	payload := map[string]string{
-		"url": d.ipAddress + ":9100",
+		"url": net.JoinHostPort(d.getIPAddress(), "9100"),
 	}
 
 	jsonData, err := json.Marshal(payload)
@@ -252,7 +473,7 @@ func (d *VirtInstanceManager) DeRegisterPromDiscovery() {
 	discoveryUrl := "http://localhost:9093/targets/node_exporter"
 
 	payload := map[string]string{
-		"url": d.ipAddress + ":9100",
+		"url": net.JoinHostPort(d.getIPAddress(), "9100"),
 	}
 
 	jsonData, err := json.Marshal(payload)
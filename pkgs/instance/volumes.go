@@ -0,0 +1,66 @@
+package instance
+
+import (
+	"encoding/xml"
+	"log"
+
+	genconfig "github.com/linlynnn/kvm-autoscaler/pkgs/gen-config"
+	libvirt "libvirt.org/go/libvirt"
+)
+
+type domainDisksXML struct {
+	Disks []struct {
+		Type   string `xml:"type,attr"`
+		Source struct {
+			Pool   string `xml:"pool,attr"`
+			Volume string `xml:"volume,attr"`
+		} `xml:"source"`
+	} `xml:"devices>disk"`
+}
+
+// KeepVolumes leaves the pool volumes of the instance in place on Shutdown,
+// e.g. for the golden instance whose overlay backs restored instances.
+func (d *VirtInstanceManager) KeepVolumes() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keepVolumes = true
+}
+
+// volumes returns the pool volumes the domain disks refer to as pool and
+// volume names.
+func (d *VirtInstanceManager) volumes() ([]genconfig.OverlayVolume, error) {
+	domainXML, err := d.getDomain().GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return nil, err
+	}
+
+	var desc domainDisksXML
+	if err := xml.Unmarshal([]byte(domainXML), &desc); err != nil {
+		return nil, err
+	}
+
+	volumes := []genconfig.OverlayVolume{}
+	for _, disk := range desc.Disks {
+		if disk.Type == "volume" {
+			volumes = append(volumes, genconfig.OverlayVolume{Pool: disk.Source.Pool, Name: disk.Source.Volume})
+		}
+	}
+	return volumes, nil
+}
+
+// deleteVolumes removes volumes through the connection of the domain, which
+// must no longer be running.
+func (d *VirtInstanceManager) deleteVolumes(volumes []genconfig.OverlayVolume) {
+	conn, err := d.getDomain().DomainGetConnect()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	for _, volume := range volumes {
+		if err := genconfig.DeleteVolume(conn, volume.Pool, volume.Name); err != nil {
+			log.Printf("[Shutdown] Failed to delete volume %s of VM %s: %v\n", volume.Name, d.GetID(), err)
+		}
+	}
+}
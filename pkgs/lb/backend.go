@@ -2,9 +2,11 @@ package lb
 
 import (
 	"log"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"sync/atomic"
 )
 
 type BackendState int
@@ -12,6 +14,9 @@ type BackendState int
 const (
 	BACKEND_STATE_ALIVE BackendState = iota
 	BACKEND_STATE_DRAINING
+	// the backend failed its health check, it gets no traffic until it
+	// passes again
+	BACKEND_STATE_UNHEALTHY
 )
 
 type Backend struct {
@@ -19,15 +24,34 @@ type Backend struct {
 	State BackendState
 	mu    sync.RWMutex
 	Proxy *httputil.ReverseProxy
+	// Weight is the share of the requests the backend gets, the weight of
+	// its instance type
+	Weight int
+	// currentWeight is the smooth weighted round-robin state, guarded by
+	// the load balancer lock
+	currentWeight int
+	// activeConnections counts the requests currently proxied to the backend
+	activeConnections atomic.Int64
+	// healthCheckFailures counts the consecutive failed health checks
+	healthCheckFailures int
 }
 
 type RegisterBackendRequest struct {
-	Name string `json:"name"`
-	URL  string `json:"url"`
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
 }
 
 type BackendResponse struct {
-	URL string `json:"url"`
+	URL               string `json:"url"`
+	Weight            int    `json:"weight"`
+	ActiveConnections int64  `json:"activeConnections"`
+}
+
+type BackendConnectionsResponse struct {
+	URL               string `json:"url"`
+	Draining          bool   `json:"draining"`
+	ActiveConnections int64  `json:"activeConnections"`
 }
 
 type BackendListRequest struct {
@@ -38,10 +62,37 @@ type DeRegisterBackendRequest struct {
 	URL string `json:"url"`
 }
 
-func (b *Backend) SetStateAlive(alive bool) {
+// ReportHealthCheck records the result of a health check and returns the
+// state after it. The backend turns unhealthy after threshold consecutive
+// failures, so that one slow response does not get its instance replaced,
+// and alive again on the first success.
+func (b *Backend) ReportHealthCheck(passed bool, threshold int) BackendState {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.State = BACKEND_STATE_ALIVE
+
+	// a draining backend stays draining until it is removed
+	if b.State == BACKEND_STATE_DRAINING {
+		return b.State
+	}
+
+	if passed {
+		b.healthCheckFailures = 0
+		b.State = BACKEND_STATE_ALIVE
+		return b.State
+	}
+
+	b.healthCheckFailures++
+	if b.healthCheckFailures >= threshold {
+		b.State = BACKEND_STATE_UNHEALTHY
+	}
+	return b.State
+}
+
+func (b *Backend) IsUnhealthy() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.State == BACKEND_STATE_UNHEALTHY
 }
 
 func (b *Backend) IsAlive() bool {
@@ -71,17 +122,34 @@ func (b *Backend) SetStateDraining(draining bool) {
 	b.State = BACKEND_STATE_DRAINING
 }
 
-func NewBackend(ipAddress string) *Backend {
+func (b *Backend) ActiveConnections() int64 {
+	return b.activeConnections.Load()
+}
+
+// ServeHTTP proxies the request and keeps the in-flight count up to date.
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.activeConnections.Add(1)
+	defer b.activeConnections.Add(-1)
+	b.Proxy.ServeHTTP(w, r)
+}
+
+func NewBackend(ipAddress string, weight int) *Backend {
 	parsedIpAddress, err := url.Parse(ipAddress)
 	if err != nil {
 		log.Println("Parse IpAddress failed")
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(parsedIpAddress)
+	// backends registered without a weight count as one
+	if weight < 1 {
+		weight = 1
+	}
+
 	backend := &Backend{
-		URL:   parsedIpAddress,
-		State: BACKEND_STATE_ALIVE,
-		Proxy: proxy,
+		URL:    parsedIpAddress,
+		State:  BACKEND_STATE_ALIVE,
+		Proxy:  proxy,
+		Weight: weight,
 	}
 
 	return backend
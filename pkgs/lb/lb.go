@@ -10,13 +10,20 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/helper"
 )
 
 type LoadBalancer struct {
 	backends []*Backend
-	current  uint64
 	address  string
 	mu       sync.Mutex
+	// drainTimeout bounds how long a deregistered backend is kept for its
+	// in-flight requests
+	drainTimeout time.Duration
+	// unhealthyThreshold is how many health checks in a row a backend has
+	// to fail before it is reported unhealthy
+	unhealthyThreshold int
 }
 
 type LoadCpuUtilRequest struct {
@@ -27,8 +34,10 @@ type LoadCpuUtilRequest struct {
 
 func NewLoadBalancer(address string) *LoadBalancer {
 	return &LoadBalancer{
-		backends: []*Backend{},
-		address:  address,
+		backends:           []*Backend{},
+		address:            address,
+		drainTimeout:       5 * time.Minute,
+		unhealthyThreshold: max(helper.GetEnvInt("HEALTH_CHECK_UNHEALTHY_THRESHOLD", 3), 1),
 	}
 }
 
@@ -107,6 +116,7 @@ func (lb *LoadBalancer) Run() {
 	r.Get("/backend", lb.GetBackendListHandler)
 	r.Post("/backend", lb.RegisterBackendHandler)
 	r.Delete("/backend", lb.DeRegisterHandler)
+	r.Get("/backend/connections", lb.GetBackendConnectionsHandler)
 	r.Post("/load/cpu", lb.LoadCpuUtilHandler)
 
 	log.Printf("[LoadBalancer] Load balancer running on %s\n", lb.address)
@@ -114,6 +124,9 @@ func (lb *LoadBalancer) Run() {
 
 }
 
+// getNextBackend picks backends by smooth weighted round-robin, so that a
+// backend of weight 4 gets four requests for each one of a backend of
+// weight 1, interleaved rather than in bursts.
 func (lb *LoadBalancer) getNextBackend() *Backend {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
@@ -123,19 +136,26 @@ func (lb *LoadBalancer) getNextBackend() *Backend {
 		return nil
 	}
 
-	start := lb.current
-	for {
-		b := lb.backends[lb.current%uint64(len(lb.backends))]
-		lb.current++
-
-		if b.IsAlive() && !b.IsDraining() {
-			return b
+	var selected *Backend
+	totalWeight := 0
+	for _, b := range lb.backends {
+		if !b.IsAlive() || b.IsDraining() {
+			continue
 		}
 
-		if lb.current%uint64(len(lb.backends)) == start {
-			return nil // No healthy backend
+		b.currentWeight += b.Weight
+		totalWeight += b.Weight
+		if selected == nil || b.currentWeight > selected.currentWeight {
+			selected = b
 		}
 	}
+
+	if selected == nil {
+		return nil // No healthy backend
+	}
+
+	selected.currentWeight -= totalWeight
+	return selected
 }
 
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -144,15 +164,26 @@ func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "No available backends", http.StatusServiceUnavailable)
 		return
 	}
-	backend.Proxy.ServeHTTP(w, r)
+	backend.ServeHTTP(w, r)
 }
 
-func (lb *LoadBalancer) registerBackend(ipAddress string) {
+func (lb *LoadBalancer) registerBackend(ipAddress string, weight int) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
-	log.Printf("[LoadBalancer] Registering backend %s\n", ipAddress)
-	newBackend := NewBackend(ipAddress)
+	log.Printf("[LoadBalancer] Registering backend %s with weight %d\n", ipAddress, weight)
+
+	// registering an instance again updates its backend, which keeps its
+	// health check. A draining one is on its way out and gets replaced.
+	for _, backend := range lb.backends {
+		if backend.URL.String() == ipAddress && !backend.IsDraining() {
+			backend.Weight = max(weight, 1)
+			log.Printf("[LoadBalancer] Updated backend %s to weight %d\n", ipAddress, backend.Weight)
+			return
+		}
+	}
+
+	newBackend := NewBackend(ipAddress, weight)
 	// start healthcheck the backend
 	lb.backends = append(lb.backends, newBackend)
 	log.Printf("[LoadBalancer] Registered backend %s\n", ipAddress)
@@ -170,7 +201,7 @@ func (lb *LoadBalancer) RegisterBackendHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	lb.registerBackend(registerBackendRequest.URL)
+	lb.registerBackend(registerBackendRequest.URL, registerBackendRequest.Weight)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Successfully registered backend"))
@@ -183,15 +214,22 @@ func (lb *LoadBalancer) startHealthCheck(backend *Backend, interval time.Duratio
 	time.Sleep(1 * time.Minute)
 	log.Printf("[LoadBalancer] Start health check %s\n", backend.URL.String())
 
-	for {
+	// unhealthy backends keep being checked so that they can recover, the
+	// autoscaler replaces those that stay unhealthy
+	for !backend.IsDraining() {
 		resp, err := http.Get(backend.URL.String() + "/health")
-		if err != nil || resp.StatusCode != http.StatusOK {
-			log.Printf("[LoadBalancer] %s Not Alive", backend.URL.String())
-			backend.SetStateAlive(false)
-			lb.deRegister(backend.URL.String())
-			break
-		} else {
-			backend.SetStateAlive(true)
+		passed := err == nil && resp.StatusCode == http.StatusOK
+
+		wasUnhealthy := backend.IsUnhealthy()
+		state := backend.ReportHealthCheck(passed, lb.unhealthyThreshold)
+		if !wasUnhealthy && state == BACKEND_STATE_UNHEALTHY {
+			log.Printf("[LoadBalancer] %s Not Alive after %d failed health checks", backend.URL.String(), lb.unhealthyThreshold)
+		} else if wasUnhealthy && state == BACKEND_STATE_ALIVE {
+			log.Printf("[LoadBalancer] %s Alive again", backend.URL.String())
+		}
+
+		if resp != nil {
+			resp.Body.Close()
 		}
 		time.Sleep(interval)
 	}
@@ -201,13 +239,20 @@ func (lb *LoadBalancer) startHealthCheck(backend *Backend, interval time.Duratio
 func (lb *LoadBalancer) getBackendList(status string) []BackendResponse {
 	var result []BackendResponse
 
+	// the weight is guarded by the load balancer lock
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
 	for _, b := range lb.backends {
 		b.mu.RLock()
-		isAlive := b.IsAlive()
-		isDraining := b.IsDraining()
+		state := b.State
 		url := b.URL
 		b.mu.RUnlock()
 
+		isAlive := state == BACKEND_STATE_ALIVE
+		isDraining := state == BACKEND_STATE_DRAINING
+		isUnhealthy := state == BACKEND_STATE_UNHEALTHY
+
 		if status == "alive" && !isAlive {
 			continue
 		}
@@ -216,8 +261,14 @@ func (lb *LoadBalancer) getBackendList(status string) []BackendResponse {
 			continue
 		}
 
+		if status == "unhealthy" && !isUnhealthy {
+			continue
+		}
+
 		result = append(result, BackendResponse{
-			URL: url.String(),
+			URL:               url.String(),
+			Weight:            b.Weight,
+			ActiveConnections: b.ActiveConnections(),
 		})
 	}
 
@@ -262,21 +313,58 @@ func (lb *LoadBalancer) deRegister(url string) {
 	lb.mu.Unlock()
 
 	go func() {
-		time.Sleep(30 * time.Second)
+		// keep the backend until its in-flight requests are done
+		deadline := time.Now().Add(lb.drainTimeout)
+		for backendToRemove.ActiveConnections() > 0 && time.Now().Before(deadline) {
+			time.Sleep(1 * time.Second)
+		}
+
 		lb.mu.Lock()
 		for idxToRemove, backend := range lb.backends {
-			if backend.URL.String() == url {
+			if backend == backendToRemove {
 				lb.backends = slices.Delete(lb.backends, idxToRemove, idxToRemove+1)
 				break
 			}
 		}
-		log.Printf("[LoadBalancer] Deregistered %s\n", url)
+		log.Printf("[LoadBalancer] Deregistered %s with %d active connections\n", url, backendToRemove.ActiveConnections())
 		lb.mu.Unlock()
 
 	}()
 
 }
 
+func (lb *LoadBalancer) getBackendConnections(url string) (BackendConnectionsResponse, bool) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for _, backend := range lb.backends {
+		if backend.URL.String() == url {
+			return BackendConnectionsResponse{
+				URL:               url,
+				Draining:          backend.IsDraining(),
+				ActiveConnections: backend.ActiveConnections(),
+			}, true
+		}
+	}
+
+	return BackendConnectionsResponse{}, false
+}
+
+// GetBackendConnectionsHandler reports the in-flight requests of one
+// backend, a removed backend answers 404 and has nothing in flight.
+func (lb *LoadBalancer) GetBackendConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+
+	result, ok := lb.getBackendConnections(url)
+	if !ok {
+		http.Error(w, "backend not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 func (lb *LoadBalancer) DeRegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	var deRegisterBackendRequest DeRegisterBackendRequest
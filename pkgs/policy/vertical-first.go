@@ -0,0 +1,120 @@
+package policy
+
+import (
+	"log"
+	"time"
+
+	"github.com/linlynnn/kvm-autoscaler/pkgs/controller"
+)
+
+// MetricSource returns the current utilization of the group, e.g. the
+// average CPU usage from Prometheus, as a ratio between 0 and 1.
+type MetricSource func() (float64, error)
+
+// VerticalFirstPolicy absorbs short spikes on small fleets by hot-plugging
+// vCPUs and memory into the running instances, which takes seconds instead
+// of the minutes a new instance needs. A spike that lasts longer than
+// SpikeDuration, or that finds no vertical headroom, scales out. Scale-in
+// shrinks the instances back to their base size before removing any.
+type VerticalFirstPolicy struct {
+	vmController      controller.VmController
+	metric            MetricSource
+	ScaleOutThreshold float64
+	ScaleInThreshold  float64
+	// SmallFleetSize is the largest fleet that is scaled vertically first
+	SmallFleetSize int
+	SpikeDuration  time.Duration
+	Interval       time.Duration
+	spikeStart     time.Time
+}
+
+func NewVerticalFirstPolicy(
+	metric MetricSource,
+	scaleOutThreshold float64,
+	scaleInThreshold float64,
+	smallFleetSize int,
+	spikeDuration time.Duration,
+	interval time.Duration,
+) *VerticalFirstPolicy {
+	return &VerticalFirstPolicy{
+		metric:            metric,
+		ScaleOutThreshold: scaleOutThreshold,
+		ScaleInThreshold:  scaleInThreshold,
+		SmallFleetSize:    smallFleetSize,
+		SpikeDuration:     spikeDuration,
+		Interval:          interval,
+	}
+}
+
+func (p *VerticalFirstPolicy) AttachVmController(vmController controller.VmController) {
+	p.vmController = vmController
+}
+
+func (p *VerticalFirstPolicy) Apply() {
+	if p.vmController == nil {
+		log.Println("[VerticalFirstPolicy] No VmController attached")
+		return
+	}
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		utilization, err := p.metric()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		p.evaluate(utilization)
+	}
+}
+
+func (p *VerticalFirstPolicy) evaluate(utilization float64) {
+	running, _, err := p.vmController.GetRunningInstance()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	up, down := p.vmController.VerticalHeadroom()
+
+	switch {
+	case utilization >= p.ScaleOutThreshold:
+		if p.spikeStart.IsZero() {
+			p.spikeStart = time.Now()
+		}
+
+		// a spike that outlasts SpikeDuration is load, not a spike
+		short := time.Since(p.spikeStart) < p.SpikeDuration
+		if short && running <= p.SmallFleetSize && up > 0 {
+			log.Printf("[VerticalFirstPolicy] Utilization %.2f on %d instances, scale vertically\n", utilization, running)
+			if p.vmController.ScaleVertical(1) > 0 {
+				return
+			}
+		}
+
+		if len(p.vmController.GetPendingLaunches()) > 0 {
+			return
+		}
+		log.Printf("[VerticalFirstPolicy] Utilization %.2f on %d instances, scale out\n", utilization, running)
+		p.vmController.ScaleUp(1)
+
+	case utilization <= p.ScaleInThreshold:
+		p.spikeStart = time.Time{}
+
+		if down > 0 {
+			log.Printf("[VerticalFirstPolicy] Utilization %.2f, shrink instances\n", utilization)
+			p.vmController.ScaleVertical(-1)
+			return
+		}
+
+		candidates := p.vmController.SelectScaleInCandidates(1)
+		if len(candidates) > 0 {
+			log.Printf("[VerticalFirstPolicy] Utilization %.2f, scale in\n", utilization)
+			p.vmController.ScaleDown(candidates)
+		}
+
+	default:
+		p.spikeStart = time.Time{}
+	}
+}